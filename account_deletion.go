@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// deletedChirpsPolicy decides what happens to the chirps of a purged account.
+type deletedChirpsPolicy string
+
+const (
+	// Chirps are deleted along with the account
+	deleteChirpsOfDeletedUsers deletedChirpsPolicy = "delete"
+	// Chirps are kept without an author
+	anonymizeChirpsOfDeletedUsers deletedChirpsPolicy = "anonymize"
+)
+
+const defaultAccountDeletionGrace = 30 * 24 * time.Hour
+
+const accountDeletedMessage = "This account is scheduled for deletion. Restore it with POST /api/users/restore"
+
+func parseDeletedChirpsPolicy(s string) (deletedChirpsPolicy, error) {
+	switch policy := deletedChirpsPolicy(s); policy {
+	case "":
+		return deleteChirpsOfDeletedUsers, nil
+	case deleteChirpsOfDeletedUsers, anonymizeChirpsOfDeletedUsers:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown deleted user chirps policy: %s", s)
+	}
+}
+
+func parseAccountDeletionGrace(days string) (time.Duration, error) {
+	if days == "" {
+		return defaultAccountDeletionGrace, nil
+	}
+
+	n, err := strconv.Atoi(days)
+
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid account deletion grace period: %s", days)
+	}
+
+	return time.Duration(n) * 24 * time.Hour, nil
+}
+
+// scheduleUserDeletion deactivates the account until it is purged and logs
+// the user out everywhere. Tokens stop working right away, since
+// authenticate rejects users that are scheduled for deletion.
+func (cfg *apiConfig) scheduleUserDeletion(ctx context.Context, userID uuid.UUID) (database.User, error) {
+	tx, err := cfg.dbConn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return database.User{}, err
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	user, err := qtx.ScheduleUserDeletion(ctx, userID)
+
+	if err != nil {
+		return database.User{}, err
+	}
+
+	err = qtx.RevokeRefreshTokensByUserId(ctx, userID)
+
+	if err != nil {
+		return database.User{}, err
+	}
+
+	return user, tx.Commit()
+}
+
+func (cfg *apiConfig) respondWithScheduledDeletion(w http.ResponseWriter, user database.User) {
+	respBody := struct {
+		DeletedAt   time.Time `json:"deleted_at"`
+		PurgeAfter  time.Time `json:"purge_after"`
+		ChirpPolicy string    `json:"chirp_policy"`
+	}{
+		DeletedAt:   user.DeletedAt.Time,
+		PurgeAfter:  user.DeletedAt.Time.Add(cfg.accountDeletionGrace),
+		ChirpPolicy: string(cfg.deletedChirpsPolicy),
+	}
+
+	respondWithJSON(w, 200, respBody)
+}
+
+// deleteUserHandler schedules the caller's account for deletion. As with a
+// login, the password and, if enabled, a second factor have to be given again.
+func (cfg *apiConfig) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), caller.UserID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving user from database")
+		return
+	}
+
+	ok = cfg.checkCurrentPassword(w, r, user, params.Password)
+
+	if !ok {
+		return
+	}
+
+	if user.TotpEnabledAt.Valid {
+		err = checkSecondFactor(r.Context(), cfg.DB, user, params.Code, params.RecoveryCode)
+
+		if errors.Is(err, errInvalidSecondFactor) {
+			cfg.recordFailedLogin(r.Context(), user.Email, cfg.clientIP(r))
+			respondWithError(w, 401, "Invalid TOTP or recovery code")
+			return
+		}
+
+		if err != nil {
+			respondWithError(w, 500, "Error checking TOTP code")
+			return
+		}
+	}
+
+	user, err = cfg.scheduleUserDeletion(r.Context(), user.ID)
+
+	if err != nil {
+		log.Printf("Error scheduling deletion of user %s: %s", caller.UserID, err)
+		respondWithError(w, 500, "Error deleting account")
+		return
+	}
+
+	cfg.respondWithScheduledDeletion(w, user)
+}
+
+// restoreUserHandler cancels the deletion of an account during the grace
+// period. The user logs in as usual afterwards. Like a login, it needs the
+// second factor if one is enabled.
+func (cfg *apiConfig) restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	ip := cfg.clientIP(r)
+
+	lock, err := cfg.loginLockedFor(r.Context(), accountThrottleKey(params.Email), ipThrottleKey(ip))
+
+	if err != nil {
+		respondWithError(w, 500, "Error checking login throttle")
+		return
+	}
+
+	if lock > 0 {
+		respondLoginLocked(w, lock)
+		return
+	}
+
+	user, err := cfg.DB.GetUserByEmail(r.Context(), params.Email)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		auth.CheckPasswordHash(dummyPasswordHash(), params.Password)
+		cfg.recordFailedLogin(r.Context(), params.Email, ip)
+		respondWithError(w, 401, "Incorrect email or password")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving user from database")
+		return
+	}
+
+	err = auth.CheckPasswordHash(user.HashedPassword, params.Password)
+
+	if err != nil {
+		cfg.recordFailedLogin(r.Context(), params.Email, ip)
+		respondWithError(w, 401, "Incorrect email or password")
+		return
+	}
+
+	// Failures are not cleared here: restoring is no login, and clearing them
+	// would let the second factor be guessed between throttled MFA logins
+	if user.TotpEnabledAt.Valid {
+		err = checkSecondFactor(r.Context(), cfg.DB, user, params.Code, params.RecoveryCode)
+
+		if errors.Is(err, errInvalidSecondFactor) {
+			cfg.recordFailedLogin(r.Context(), user.Email, ip)
+			respondWithError(w, 401, "Invalid TOTP or recovery code")
+			return
+		}
+
+		if err != nil {
+			respondWithError(w, 500, "Error checking TOTP code")
+			return
+		}
+	}
+
+	n, err := cfg.DB.RestoreUser(r.Context(), user.ID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error restoring account")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 409, "Account is not scheduled for deletion")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// adminDeleteUserHandler schedules any account for deletion, with the same
+// grace period as self-service deletion.
+func (cfg *apiConfig) adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid userID")
+		return
+	}
+
+	user, err := cfg.scheduleUserDeletion(r.Context(), userID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "User not found or already scheduled for deletion")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error scheduling deletion of user %s: %s", userID, err)
+		respondWithError(w, 500, "Error deleting account")
+		return
+	}
+
+	cfg.respondWithScheduledDeletion(w, user)
+}
+
+func (cfg *apiConfig) adminRestoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid userID")
+		return
+	}
+
+	n, err := cfg.DB.RestoreUser(r.Context(), userID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error restoring account")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 404, "User not found or not scheduled for deletion")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// runAccountPurger purges accounts whose grace period has passed, every
+// interval until ctx is done.
+func (cfg *apiConfig) runAccountPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := cfg.purgeDeletedUsers(ctx)
+
+		if err != nil {
+			log.Printf("Error purging deleted accounts: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) purgeDeletedUsers(ctx context.Context) error {
+	cutoff := time.Now().Add(-cfg.accountDeletionGrace)
+	userIDs, err := cfg.DB.ListUsersDueForPurge(ctx, cutoff)
+
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		purged, err := cfg.purgeUser(ctx, userID, cutoff)
+
+		if err != nil {
+			return fmt.Errorf("purging user %s: %w", userID, err)
+		}
+
+		if purged {
+			log.Printf("Purged deleted account %s", userID)
+		}
+	}
+
+	return nil
+}
+
+// purgeUser deletes the account for good. Everything else the user owns goes
+// with it through ON DELETE CASCADE, except chirps, which the policy decides on.
+// It reports false, changing nothing, when the account is no longer deleted
+// since before cutoff: restored, or deleted again, after it was listed.
+func (cfg *apiConfig) purgeUser(ctx context.Context, userID uuid.UUID, cutoff time.Time) (bool, error) {
+	tx, err := cfg.dbConn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	// Held until commit, so the account can't be restored while its chirps go
+	_, err = qtx.LockUserForPurge(ctx, database.LockUserForPurgeParams{
+		ID:     userID,
+		Cutoff: cutoff,
+	})
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	author := uuid.NullUUID{UUID: userID, Valid: true}
+
+	// Rechirps have nothing to keep, whatever the policy
+	err = qtx.DeleteRechirpsByUserId(ctx, author)
+
+	if err != nil {
+		return false, err
+	}
+
+	if cfg.deletedChirpsPolicy == deleteChirpsOfDeletedUsers {
+		// Each round deletes the chirps nothing refers to anymore, so replies
+		// to the user's own chirps go before the chirps they reply to
+		refs := []uuid.UUID{}
+
+		for {
+			deleted, err := qtx.DeleteChirpsByUserId(ctx, author)
+
+			if err != nil {
+				return false, err
+			}
+
+			if len(deleted) == 0 {
+				break
+			}
+
+			for _, chirp := range deleted {
+				refs = appendChirpRefs(refs, chirp.InReplyToID, chirp.QuoteOfID)
+			}
+		}
+
+		// Chirps others replied to or quoted become tombstones, like when deleted one by one
+		err = qtx.TombstoneChirpsByUserId(ctx, author)
+
+		if err != nil {
+			return false, err
+		}
+
+		err = pruneTombstones(ctx, qtx, refs)
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	n, err := qtx.PurgeUser(ctx, database.PurgeUserParams{
+		ID:     userID,
+		Cutoff: cutoff,
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	// Not expected with the row locked, but the chirps must not go without the account
+	if n == 0 {
+		return false, nil
+	}
+
+	return true, tx.Commit()
+}
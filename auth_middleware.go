@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+// tokenKind is the kind of credential a request was authenticated with.
+type tokenKind string
+
+const (
+	// Access token from a login, not limited by scopes
+	tokenKindJWT tokenKind = "jwt"
+	// Personal access token, limited to its scopes
+	tokenKindPersonal tokenKind = "personal_access_token"
+	// Access token issued to a third-party app, limited to the granted scopes
+	tokenKindOAuth tokenKind = "oauth"
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	UserID uuid.UUID
+	Role   auth.Role
+	Kind   tokenKind
+	// nil means the token is not limited by scopes
+	Scopes []string
+}
+
+func (p principal) hasScope(scope string) bool {
+	return p.Scopes == nil || slices.Contains(p.Scopes, scope)
+}
+
+type principalContextKey struct{}
+
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// principalFrom returns the caller put into the context by middlewareAuth.
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(principal)
+	return p, ok
+}
+
+// authRequirement declares what a route expects from the Authorization header.
+type authRequirement int
+
+const (
+	// The caller must be authenticated
+	authRequired authRequirement = iota
+	// Anonymous callers are fine, but credentials that are sent must be valid
+	authOptional
+	// The route is for anonymous callers only, like login or sign-up
+	authForbidden
+)
+
+var errNoCredentials = errors.New("no credentials in the request")
+
+// authenticate resolves the bearer token or access token cookie of the
+// request into a principal.
+func (cfg *apiConfig) authenticate(r *http.Request) (principal, error) {
+	token, _, err := requestToken(r, accessTokenCookie)
+
+	if err != nil {
+		return principal{}, err
+	}
+
+	p := principal{Kind: tokenKindJWT}
+
+	if auth.IsPersonalAccessToken(token) {
+		pat, err := cfg.DB.GetPersonalAccessTokenByHash(r.Context(), auth.HashToken(token))
+
+		if err != nil {
+			return principal{}, fmt.Errorf("unknown personal access token: %w", err)
+		}
+
+		if pat.RevokedAt.Valid {
+			return principal{}, fmt.Errorf("personal access token has been revoked")
+		}
+
+		if pat.ExpiresAt.Valid && time.Now().After(pat.ExpiresAt.Time) {
+			return principal{}, fmt.Errorf("personal access token expired")
+		}
+
+		err = cfg.DB.TouchPersonalAccessToken(r.Context(), pat.ID)
+
+		if err != nil {
+			log.Printf("Error updating personal access token: %s", err)
+		}
+
+		p = principal{
+			UserID: pat.UserID,
+			Kind:   tokenKindPersonal,
+			Scopes: pat.Scopes,
+		}
+	} else {
+		accessToken, err := auth.ValidateAccessToken(token, cfg.jwtKeys)
+
+		if err != nil {
+			return principal{}, err
+		}
+
+		p.UserID = accessToken.UserID
+
+		if accessToken.ClientID != uuid.Nil {
+			// Access tokens of a deleted app stop working right away
+			_, err = cfg.DB.GetOAuthClient(r.Context(), accessToken.ClientID)
+
+			if err != nil {
+				return principal{}, fmt.Errorf("unknown OAuth client: %w", err)
+			}
+
+			p.Kind = tokenKindOAuth
+			p.Scopes = accessToken.Scopes
+		}
+	}
+
+	// The role is looked up on every request, so promotions and demotions
+	// take effect without waiting for tokens to expire
+	user, err := cfg.DB.GetUserById(r.Context(), p.UserID)
+
+	if err != nil {
+		return principal{}, fmt.Errorf("user not found: %w", err)
+	}
+
+	if user.DeletedAt.Valid {
+		return principal{}, fmt.Errorf("user %s is scheduled for deletion", user.ID)
+	}
+
+	p.Role = auth.Role(user.Role)
+
+	return p, nil
+}
+
+// respondUnauthorized answers 401 with a WWW-Authenticate challenge (RFC 6750).
+func respondUnauthorized(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNoCredentials) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy", error="invalid_token"`)
+	}
+
+	respondWithError(w, 401, "Unauthorized")
+}
+
+// middlewareAuth authenticates the request according to the route's
+// requirement and puts the caller into the request context.
+func (cfg *apiConfig) middlewareAuth(requirement authRequirement, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requirement == authForbidden {
+			if r.Header.Get("Authorization") != "" {
+				respondWithError(w, 400, "This endpoint does not accept credentials")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := cfg.authenticate(r)
+
+		if errors.Is(err, errInvalidCSRFToken) {
+			respondWithError(w, 403, "Missing or invalid CSRF token")
+			return
+		}
+
+		if errors.Is(err, errNoCredentials) && requirement == authOptional {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Authentication failed: %s", err)
+			respondUnauthorized(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// middlewareRequireRole only lets through users logged in with a role of at
+// least the required one. Personal access tokens and app tokens never grant a role.
+func (cfg *apiConfig) middlewareRequireRole(required auth.Role, next http.HandlerFunc) http.Handler {
+	return cfg.middlewareAuth(authRequired, func(w http.ResponseWriter, r *http.Request) {
+		p, _ := principalFrom(r.Context())
+
+		if p.Kind != tokenKindJWT || !auth.HasRole(p.Role, required) {
+			respondWithError(w, 403, "You are not authorized to access this resource")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireScope returns the caller of a route behind middlewareAuth(authRequired),
+// answering 403 if their token lacks the scope.
+func requireScope(w http.ResponseWriter, r *http.Request, scope string) (principal, bool) {
+	p, ok := principalFrom(r.Context())
+
+	if !ok {
+		respondUnauthorized(w, errNoCredentials)
+		return principal{}, false
+	}
+
+	if !p.hasScope(scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="insufficient_scope", scope="%s"`, scope))
+		respondWithError(w, 403, "Token does not have the required scope")
+		return principal{}, false
+	}
+
+	return p, true
+}
+
+// requireLogin returns the caller of a route behind middlewareAuth(authRequired),
+// answering 403 unless they used a JWT from a login. Account security settings
+// such as sessions, two-factor and tokens can't be changed with a personal
+// access token or by a third-party app.
+func requireLogin(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	p, ok := principalFrom(r.Context())
+
+	if !ok {
+		respondUnauthorized(w, errNoCredentials)
+		return principal{}, false
+	}
+
+	if p.Kind != tokenKindJWT {
+		respondWithError(w, 403, "This endpoint requires a login, not a personal access token or app token")
+		return principal{}, false
+	}
+
+	return p, true
+}
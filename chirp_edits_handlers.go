@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultEditWindow    = 15 * time.Minute
+	defaultRedEditWindow = time.Hour
+)
+
+// editWindows is how long after posting its author can edit a chirp.
+// Chirpy Red subscribers get their own, usually longer, window.
+type editWindows struct {
+	regular time.Duration
+	red     time.Duration
+}
+
+func (windows editWindows) forUser(user database.User) time.Duration {
+	if user.IsChirpyRed.Valid && user.IsChirpyRed.Bool {
+		return windows.red
+	}
+
+	return windows.regular
+}
+
+// parseEditWindow reads a window in minutes. 0 turns editing off.
+func parseEditWindow(minutes string, fallback time.Duration) (time.Duration, error) {
+	if minutes == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(minutes)
+
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid chirp edit window: %s", minutes)
+	}
+
+	return time.Duration(n) * time.Minute, nil
+}
+
+// ChirpRevision is an earlier body of an edited chirp.
+type ChirpRevision struct {
+	Body string `json:"body"`
+	// When the body was written, and when an edit replaced it
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// editChirpHandler replaces the body of a chirp, keeping the previous one as
+// a revision. Only the author can edit, and only within the edit window.
+func (cfg *apiConfig) editChirpHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirpID")
+		return
+	}
+
+	caller, ok := requireScope(w, r, auth.ScopeChirpsWrite)
+
+	if !ok {
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), caller.UserID)
+
+	if err != nil {
+		log.Printf("Error retrieving user from database: %s", err)
+		w.WriteHeader(401)
+		return
+	}
+
+	if !cfg.unverifiedPolicy.canPostChirps(user) {
+		respondWithError(w, 403, "Verify your email address before posting chirps")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
+
+	if err != nil {
+		log.Printf("Error starting transaction: %s", err)
+		respondWithError(w, 500, "Error editing chirp")
+		return
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	chirp, err := qtx.GetChirpForUpdate(r.Context(), chirpID)
+
+	if errors.Is(err, sql.ErrNoRows) || err == nil && chirp.DeletedAt.Valid {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving chirp from database: %s", err)
+		respondWithError(w, 500, "Error editing chirp")
+		return
+	}
+
+	if !chirp.UserID.Valid || chirp.UserID.UUID != caller.UserID {
+		respondWithError(w, 403, "You are not authorized to edit this chirp")
+		return
+	}
+
+	if chirp.RechirpOfID.Valid {
+		respondWithError(w, 400, "A rechirp has no body to edit")
+		return
+	}
+
+	body, err := validateChirpBody(params.Body, chirp.QuoteOfID.Valid)
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	if time.Now().After(chirp.CreatedAt.Add(cfg.editWindows.forUser(user))) {
+		respondWithError(w, 403, "The edit window for this chirp has closed")
+		return
+	}
+
+	// Saving the same body again is not an edit
+	if body != chirp.Body {
+		// updated_at is when the current body was written, by the post or the last edit
+		err = qtx.CreateChirpRevision(r.Context(), database.CreateChirpRevisionParams{
+			ChirpID:   chirp.ID,
+			Body:      chirp.Body,
+			CreatedAt: chirp.UpdatedAt,
+		})
+
+		if err != nil {
+			log.Printf("Error saving chirp revision: %s", err)
+			respondWithError(w, 500, "Error editing chirp")
+			return
+		}
+
+		updated, err := qtx.UpdateChirpBody(r.Context(), database.UpdateChirpBodyParams{
+			ID:   chirp.ID,
+			Body: body,
+		})
+
+		if err != nil {
+			log.Printf("Error updating chirp: %s", err)
+			respondWithError(w, 500, "Error editing chirp")
+			return
+		}
+
+		chirp = database.GetChirpForUpdateRow(updated)
+
+		err = tx.Commit()
+
+		if err != nil {
+			log.Printf("Error committing chirp edit: %s", err)
+			respondWithError(w, 500, "Error editing chirp")
+			return
+		}
+	}
+
+	respBody := []Chirp{toChirp(chirp)}
+	err = cfg.prepareChirps(r, respBody)
+
+	if err != nil {
+		log.Printf("Error preparing chirp: %s", err)
+		respondWithError(w, 500, "Error editing chirp")
+		return
+	}
+
+	respondWithJSON(w, 200, respBody[0])
+}
+
+// listChirpRevisionsHandler returns the earlier bodies of a chirp, most
+// recently replaced first.
+func (cfg *apiConfig) listChirpRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirpID")
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirp, err := cfg.DB.GetChirp(r.Context(), chirpID)
+
+	if errors.Is(err, sql.ErrNoRows) || err == nil && chirp.DeletedAt.Valid {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving chirp from database: %s", err)
+		respondWithError(w, 500, "Error retrieving revisions")
+		return
+	}
+
+	beforeReplacedAt, beforeID := cursorArgs(page.After)
+
+	rows, err := cfg.DB.ListChirpRevisions(r.Context(), database.ListChirpRevisionsParams{
+		ChirpID:          chirp.ID,
+		BeforeReplacedAt: beforeReplacedAt,
+		BeforeID:         beforeID,
+		PageSize:         int32(page.Limit + 1),
+	})
+
+	if err != nil {
+		log.Printf("Error retrieving chirp revisions: %s", err)
+		respondWithError(w, 500, "Error retrieving revisions")
+		return
+	}
+
+	rows, next := pagination.Cut(rows, page, func(row database.ChirpRevision) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: row.ReplacedAt, ID: row.ID}
+	})
+
+	respBody := struct {
+		Revisions  []ChirpRevision `json:"revisions"`
+		NextCursor string          `json:"next_cursor,omitempty"`
+	}{
+		Revisions:  make([]ChirpRevision, len(rows)),
+		NextCursor: next,
+	}
+
+	for i, row := range rows {
+		respBody.Revisions[i] = ChirpRevision{
+			Body:       row.Body,
+			CreatedAt:  row.CreatedAt,
+			ReplacedAt: row.ReplacedAt,
+		}
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
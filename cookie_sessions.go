@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+)
+
+// Browser clients can log in with "use_cookies" to get their tokens in
+// HttpOnly cookies instead of the response body, so the tokens are never
+// reachable from JavaScript. Requests authenticated by cookie that change
+// state must echo the CSRF cookie in the X-CSRF-Token header (double submit).
+const (
+	accessTokenCookie  = "chirpy_access_token"
+	refreshTokenCookie = "chirpy_refresh_token"
+	csrfTokenCookie    = "chirpy_csrf_token"
+	csrfTokenHeader    = "X-CSRF-Token"
+)
+
+var errInvalidCSRFToken = errors.New("missing or invalid CSRF token")
+
+// requestToken returns the token of the request: the Bearer token if there is
+// an Authorization header, the named cookie otherwise. fromCookie reports which
+// one it was. Cookie tokens on state-changing requests must pass the CSRF check.
+func requestToken(r *http.Request, cookieName string) (token string, fromCookie bool, err error) {
+	if r.Header.Get("Authorization") != "" {
+		token, err = auth.GetBearerToken(r.Header)
+		return token, false, err
+	}
+
+	cookie, err := r.Cookie(cookieName)
+
+	if err != nil || cookie.Value == "" {
+		return "", false, errNoCredentials
+	}
+
+	if !isSafeMethod(r.Method) {
+		err = checkCSRF(r)
+
+		if err != nil {
+			return "", true, err
+		}
+	}
+
+	return cookie.Value, true, nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// checkCSRF compares the CSRF header with the CSRF cookie. Another site can make
+// the browser send our cookies, but it can't read them to fill in the header.
+func checkCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(csrfTokenCookie)
+
+	if err != nil || cookie.Value == "" {
+		return errInvalidCSRFToken
+	}
+
+	header := r.Header.Get(csrfTokenHeader)
+
+	if subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+		return errInvalidCSRFToken
+	}
+
+	return nil
+}
+
+// setSessionCookies writes the tokens of a session as cookies. The refresh token
+// is only sent to the API, and the CSRF token is the one cookie scripts can read.
+func setSessionCookies(w http.ResponseWriter, accessToken, refreshToken string, refreshExpiresAt time.Time, csrfToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessTokenCookie,
+		Value:    accessToken,
+		Path:     "/",
+		MaxAge:   int(accessTokenExpiration.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    refreshToken,
+		Path:     "/api",
+		Expires:  refreshExpiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfTokenCookie,
+		Value:    csrfToken,
+		Path:     "/",
+		Expires:  refreshExpiresAt,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// clearSessionCookies makes the browser forget the session cookies on logout.
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, cookie := range []struct{ name, path string }{
+		{accessTokenCookie, "/"},
+		{refreshTokenCookie, "/api"},
+		{csrfTokenCookie, "/"},
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookie.name,
+			Path:     cookie.path,
+			MaxAge:   -1,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/mailer"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// unverifiedUserPolicy decides what users who haven't verified their email can do.
+type unverifiedUserPolicy string
+
+const (
+	// Unverified users can do everything
+	allowUnverified unverifiedUserPolicy = "allow"
+	// Unverified users can log in but cannot post chirps
+	noChirpsUnverified unverifiedUserPolicy = "no_chirps"
+	// Unverified users cannot log in at all
+	noLoginUnverified unverifiedUserPolicy = "no_login"
+)
+
+func parseUnverifiedUserPolicy(s string) (unverifiedUserPolicy, error) {
+	switch policy := unverifiedUserPolicy(s); policy {
+	case "":
+		return noChirpsUnverified, nil
+	case allowUnverified, noChirpsUnverified, noLoginUnverified:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown unverified user policy: %s", s)
+	}
+}
+
+func (p unverifiedUserPolicy) canPostChirps(user database.User) bool {
+	return p == allowUnverified || user.EmailVerifiedAt.Valid
+}
+
+func (p unverifiedUserPolicy) canLogIn(user database.User) bool {
+	return p != noLoginUnverified || user.EmailVerifiedAt.Valid
+}
+
+// validEmail accepts bare addresses like "user@example.com",
+// without a display name or angle brackets.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// sendEmailVerification mails a verification token for the given address.
+// Once confirmed, the address becomes the user's login email.
+func (cfg *apiConfig) sendEmailVerification(ctx context.Context, userID uuid.UUID, email string) error {
+	verificationToken, err := auth.MakeEmailVerificationToken()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.DB.CreateEmailVerificationToken(ctx, database.CreateEmailVerificationTokenParams{
+		TokenHash: auth.HashToken(verificationToken),
+		UserID:    userID,
+		Email:     email,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf(
+			"Please confirm that this is your email address.\n\n"+
+				"Use this token with /api/users/verify within the next 24 hours:\n\n%s\n\n"+
+				"If you didn't ask for this, you can ignore this message.",
+			verificationToken,
+		),
+	})
+}
+
+// verifyEmailHandler confirms an email address with a verification token.
+// The token is read from the `token` query parameter (GET, for links in mails)
+// or from the JSON body (POST).
+func (cfg *apiConfig) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	params := parameters{}
+	if r.Method == http.MethodGet {
+		params.Token = r.URL.Query().Get("token")
+	} else {
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, "Error decoding parameters")
+			return
+		}
+	}
+
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
+
+	if err != nil {
+		respondWithError(w, 500, "Error starting transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	verificationToken, err := qtx.GetEmailVerificationTokenForUpdate(r.Context(), auth.HashToken(params.Token))
+
+	if err != nil {
+		respondWithError(w, 401, "Invalid verification token")
+		return
+	}
+
+	if verificationToken.UsedAt.Valid {
+		respondWithError(w, 401, "Verification token has already been used")
+		return
+	}
+
+	if time.Now().After(verificationToken.ExpiresAt) {
+		respondWithError(w, 401, "Verification token expired")
+		return
+	}
+
+	user, err := qtx.GetUserById(r.Context(), verificationToken.UserID)
+
+	if err != nil {
+		respondWithError(w, 404, "User not found in database")
+		return
+	}
+
+	// A token is only good for the address the user currently wants:
+	// their sign-up email, or the latest pending email change
+	isCurrentEmail := verificationToken.Email == user.Email
+	isPendingEmail := user.PendingEmail.Valid && verificationToken.Email == user.PendingEmail.String
+
+	if !isCurrentEmail && !isPendingEmail {
+		respondWithError(w, 401, "Verification token has been superseded")
+		return
+	}
+
+	err = qtx.VerifyUserEmail(r.Context(), database.VerifyUserEmailParams{
+		ID:    user.ID,
+		Email: verificationToken.Email,
+	})
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		respondWithError(w, 409, "Email is already in use")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating user in database")
+		return
+	}
+
+	err = qtx.MarkEmailVerificationTokenUsed(r.Context(), verificationToken.TokenHash)
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating verification token")
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		respondWithError(w, 500, "Error committing email verification")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// resendEmailVerificationHandler sends a new verification mail for the
+// pending email change or, if there is none, for the unverified sign-up email.
+func (cfg *apiConfig) resendEmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), caller.UserID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "User not found in database")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving user from database")
+		return
+	}
+
+	email := user.Email
+	if user.PendingEmail.Valid {
+		email = user.PendingEmail.String
+	} else if user.EmailVerifiedAt.Valid {
+		respondWithError(w, 409, "Email is already verified")
+		return
+	}
+
+	err = cfg.sendEmailVerification(r.Context(), user.ID, email)
+
+	if err != nil {
+		log.Printf("Error sending verification mail: %s", err)
+		respondWithError(w, 500, "Error sending verification mail")
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
+)
+
+// FollowListEntry is a user in a follower or following listing.
+type FollowListEntry struct {
+	Author
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+func (cfg *apiConfig) followUserHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireScope(w, r, auth.ScopeFollowsWrite)
+
+	if !ok {
+		return
+	}
+
+	followee, err := cfg.lookupUser(r.Context(), r.PathValue("idOrHandle"))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving user from database")
+		return
+	}
+
+	if followee.ID == caller.UserID {
+		respondWithError(w, 400, "You can't follow yourself")
+		return
+	}
+
+	// Following twice is not an error, the original follow date is kept
+	err = cfg.DB.FollowUser(r.Context(), database.FollowUserParams{
+		FollowerID: caller.UserID,
+		FolloweeID: followee.ID,
+	})
+
+	if err != nil {
+		log.Printf("Error following user: %s", err)
+		respondWithError(w, 500, "Error following user")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireScope(w, r, auth.ScopeFollowsWrite)
+
+	if !ok {
+		return
+	}
+
+	followee, err := cfg.lookupUser(r.Context(), r.PathValue("idOrHandle"))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving user from database")
+		return
+	}
+
+	err = cfg.DB.UnfollowUser(r.Context(), database.UnfollowUserParams{
+		FollowerID: caller.UserID,
+		FolloweeID: followee.ID,
+	})
+
+	if err != nil {
+		log.Printf("Error unfollowing user: %s", err)
+		respondWithError(w, 500, "Error unfollowing user")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) listFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.listFollows(w, r, func(user database.User, page pagination.Page) ([]FollowListEntry, error) {
+		beforeFollowedAt, beforeID := cursorArgs(page.After)
+
+		rows, err := cfg.DB.ListFollowers(r.Context(), database.ListFollowersParams{
+			UserID:           user.ID,
+			BeforeFollowedAt: beforeFollowedAt,
+			BeforeID:         beforeID,
+			PageSize:         int32(page.Limit + 1),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries := make([]FollowListEntry, len(rows))
+		for i, row := range rows {
+			entries[i] = FollowListEntry{
+				Author:     Author{ID: row.ID, Handle: row.Handle, DisplayName: row.DisplayName, AvatarURL: row.AvatarUrl},
+				FollowedAt: row.FollowedAt,
+			}
+		}
+
+		return entries, nil
+	})
+}
+
+func (cfg *apiConfig) listFollowingHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.listFollows(w, r, func(user database.User, page pagination.Page) ([]FollowListEntry, error) {
+		beforeFollowedAt, beforeID := cursorArgs(page.After)
+
+		rows, err := cfg.DB.ListFollowing(r.Context(), database.ListFollowingParams{
+			UserID:           user.ID,
+			BeforeFollowedAt: beforeFollowedAt,
+			BeforeID:         beforeID,
+			PageSize:         int32(page.Limit + 1),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries := make([]FollowListEntry, len(rows))
+		for i, row := range rows {
+			entries[i] = FollowListEntry{
+				Author:     Author{ID: row.ID, Handle: row.Handle, DisplayName: row.DisplayName, AvatarURL: row.AvatarUrl},
+				FollowedAt: row.FollowedAt,
+			}
+		}
+
+		return entries, nil
+	})
+}
+
+// listFollows answers a follower or following listing, newest follows first.
+// list fetches one more entry than the page holds, to tell if there is a next page.
+func (cfg *apiConfig) listFollows(w http.ResponseWriter, r *http.Request, list func(database.User, pagination.Page) ([]FollowListEntry, error)) {
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	user, err := cfg.lookupUser(r.Context(), r.PathValue("idOrHandle"))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving user from database")
+		return
+	}
+
+	entries, err := list(user, page)
+
+	if err != nil {
+		log.Printf("Error listing follows: %s", err)
+		respondWithError(w, 500, "Error retrieving follows from database")
+		return
+	}
+
+	entries, next := pagination.Cut(entries, page, func(entry FollowListEntry) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: entry.FollowedAt, ID: entry.ID}
+	})
+
+	respBody := struct {
+		Users      []FollowListEntry `json:"users"`
+		NextCursor string            `json:"next_cursor,omitempty"`
+	}{
+		Users:      entries,
+		NextCursor: next,
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
+
+// timelineHandler returns the chirps of the accounts the caller follows,
+// newest first. Pass next_cursor back as ?cursor= for the following page.
+func (cfg *apiConfig) timelineHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principalFrom(r.Context())
+
+	if !ok {
+		respondUnauthorized(w, errNoCredentials)
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	beforeCreatedAt, beforeID := cursorArgs(page.After)
+
+	chirps, err := cfg.DB.GetTimeline(r.Context(), database.GetTimelineParams{
+		BeforeCreatedAt: beforeCreatedAt,
+		BeforeID:        beforeID,
+		PageSize:        int32(page.Limit + 1),
+		UserID:          caller.UserID,
+	})
+
+	if err != nil {
+		log.Printf("Error retrieving timeline from database: %s", err)
+		respondWithError(w, 500, "Error retrieving timeline")
+		return
+	}
+
+	chirps, next := pagination.Cut(chirps, page, chirpCursor)
+
+	respBody := struct {
+		Chirps     []Chirp `json:"chirps"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}{
+		Chirps:     make([]Chirp, len(chirps)),
+		NextCursor: next,
+	}
+
+	for i, chirp := range chirps {
+		respBody.Chirps[i] = toChirp(chirp)
+	}
+
+	err = cfg.prepareChirps(r, respBody.Chirps)
+
+	if err != nil {
+		log.Printf("Error preparing chirps: %s", err)
+		respondWithError(w, 500, "Error retrieving timeline")
+		return
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
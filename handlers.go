@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
@@ -29,9 +34,17 @@ func (cfg *apiConfig) middlewareMetrics(next http.Handler) http.Handler {
 func (cfg *apiConfig) resetMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	cfg.fileserverHits.Store(0)
 
+	// Even for admins, wiping every user is only possible on a dev server
 	if cfg.env == "dev" {
-		cfg.DB.DeleteUsers(r.Context())
-		err := cfg.DB.DeleteUsers(r.Context())
+		// Chirps outlive their authors now, so they have to go first
+		err := cfg.DB.DeleteChirps(r.Context())
+		if err != nil {
+			http.Error(w, "Couldn't delete chirps", http.StatusInternalServerError)
+			return
+		}
+		// Everyone but the admin resetting goes, so the next reset needs no new promotion
+		caller, _ := principalFrom(r.Context())
+		err = cfg.DB.DeleteOtherUsers(r.Context(), caller.UserID)
 		if err != nil {
 			http.Error(w, "Couldn't delete users", http.StatusInternalServerError)
 			return
@@ -47,3 +60,48 @@ func readinessHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
+
+func (cfg *apiConfig) updateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid userID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	role, err := auth.ParseRole(params.Role)
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	n, err := cfg.DB.SetUserRoleById(r.Context(), database.SetUserRoleByIdParams{
+		ID:   userID,
+		Role: string(role),
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating user in database")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 404, "User not found in database")
+		return
+	}
+
+	w.WriteHeader(204)
+}
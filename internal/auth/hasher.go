@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords into self-describing strings in PHC format
+// ($<id>$<params>$<salt>$<hash>), so a stored hash says which algorithm and
+// parameters made it and old hashes keep working after a change.
+type PasswordHasher interface {
+	// IDs are the algorithm identifiers this hasher can verify, e.g. "argon2id"
+	IDs() []string
+	Hash(password string) (string, error)
+	Verify(encoded, password string) error
+	// NeedsRehash reports whether the hash was made with weaker parameters
+	// than the ones the hasher currently uses.
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2idHasher hashes with argon2id, see RFC 9106.
+type Argon2idHasher struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idHasher uses the second recommended option of RFC 9106.
+var DefaultArgon2idHasher = Argon2idHasher{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func (h Argon2idHasher) IDs() []string {
+	return []string{"argon2id"}
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	_, err := rand.Read(salt)
+
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// decode parses an argon2id PHC string into its parameters, salt and key.
+func (h Argon2idHasher) decode(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Argon2idHasher{}, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2idHasher{}, nil, nil, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+	}
+
+	params := Argon2idHasher{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return Argon2idHasher{}, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2idHasher{}, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2idHasher{}, nil, nil, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+func (h Argon2idHasher) Verify(encoded, password string) error {
+	params, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return fmt.Errorf("password does not match")
+	}
+
+	return nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory < h.Memory ||
+		params.Iterations < h.Iterations ||
+		params.Parallelism < h.Parallelism ||
+		params.SaltLength < h.SaltLength ||
+		params.KeyLength < h.KeyLength
+}
+
+// BcryptHasher verifies the bcrypt hashes ($2a$, $2b$, $2y$) stored before
+// argon2id was introduced. It can still hash, but silently truncates
+// passwords longer than 72 bytes.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) IDs() []string {
+	return []string{"2a", "2b", "2y"}
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	res, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(res), nil
+}
+
+func (h BcryptHasher) Verify(encoded, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+var (
+	hashersMu sync.RWMutex
+	// The hasher new passwords are hashed with
+	preferredHasher PasswordHasher = DefaultArgon2idHasher
+	// Every hasher that can verify stored hashes, by algorithm identifier
+	hashers = map[string]PasswordHasher{}
+)
+
+func init() {
+	RegisterPasswordHasher(DefaultArgon2idHasher)
+	RegisterPasswordHasher(BcryptHasher{Cost: bcrypt.DefaultCost})
+}
+
+// RegisterPasswordHasher makes a hasher available for verifying stored hashes
+// with any of its algorithm identifiers.
+func RegisterPasswordHasher(h PasswordHasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+
+	for _, id := range h.IDs() {
+		hashers[id] = h
+	}
+}
+
+// SetPasswordHasher changes the hasher used for new passwords and registers it.
+// Existing hashes made with other algorithms or weaker parameters are upgraded
+// the next time their user logs in, see PasswordNeedsRehash.
+func SetPasswordHasher(h PasswordHasher) {
+	RegisterPasswordHasher(h)
+
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+
+	preferredHasher = h
+}
+
+// hashID extracts the algorithm identifier from a "$<id>$..." string.
+func hashID(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// UnusablePasswordHash is stored for accounts created through an identity
+// provider. It isn't in any hasher's format, so no password ever matches it
+// until the user sets one with a password reset.
+const UnusablePasswordHash = "!"
+
+func HashPassword(password string) (string, error) {
+	hashersMu.RLock()
+	h := preferredHasher
+	hashersMu.RUnlock()
+
+	return h.Hash(password)
+}
+
+// CheckPasswordHash verifies the password with whichever algorithm made the hash.
+func CheckPasswordHash(hash, password string) error {
+	hashersMu.RLock()
+	h, ok := hashers[hashID(hash)]
+	hashersMu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("unknown password hash format")
+	}
+
+	return h.Verify(hash, password)
+}
+
+// PasswordNeedsRehash reports whether the hash should be replaced, because it
+// was made by another algorithm than the preferred one or with weaker parameters.
+// Call it after a successful CheckPasswordHash, while the password is at hand.
+func PasswordNeedsRehash(hash string) bool {
+	hashersMu.RLock()
+	h := preferredHasher
+	hashersMu.RUnlock()
+
+	for _, id := range h.IDs() {
+		if hashID(hash) == id {
+			return h.NeedsRehash(hash)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	// A password longer than the 72 bytes bcrypt would look at
+	password := strings.Repeat("a", 80)
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=4$") {
+		t.Fatalf("Expected an argon2id PHC string, got %s", hash)
+	}
+
+	if err := CheckPasswordHash(hash, password); err != nil {
+		t.Fatalf("Correct password should match: %v", err)
+	}
+
+	if err := CheckPasswordHash(hash, strings.Repeat("a", 79)+"b"); err == nil {
+		t.Fatal("Password differing after 72 bytes should not match")
+	}
+
+	if PasswordNeedsRehash(hash) {
+		t.Fatal("Fresh hash should not need a rehash")
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("Failed to make bcrypt hash: %v", err)
+	}
+
+	if err := CheckPasswordHash(string(legacy), "password123"); err != nil {
+		t.Fatalf("Legacy bcrypt hash should still verify: %v", err)
+	}
+
+	if !PasswordNeedsRehash(string(legacy)) {
+		t.Fatal("bcrypt hash should need a rehash")
+	}
+
+	weak := DefaultArgon2idHasher
+	weak.Iterations = 1
+	weakHash, err := weak.Hash("password123")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	if err := CheckPasswordHash(weakHash, "password123"); err != nil {
+		t.Fatalf("Hash with other parameters should still verify: %v", err)
+	}
+
+	if !PasswordNeedsRehash(weakHash) {
+		t.Fatal("Hash with weaker parameters should need a rehash")
+	}
+
+	if err := CheckPasswordHash("unset", "password123"); err == nil {
+		t.Fatal("Unknown hash format should not verify")
+	}
+}
+
+func TestUnusablePasswordHash(t *testing.T) {
+	for _, password := range []string{"", "!", "password"} {
+		if err := CheckPasswordHash(UnusablePasswordHash, password); err == nil {
+			t.Errorf("Password %q should not match the unusable hash", password)
+		}
+	}
+}
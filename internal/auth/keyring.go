@@ -0,0 +1,414 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a single asymmetric key held by a KeyRing.
+// Retired keys are no longer used for signing but are still published in
+// the JWKS and accepted when validating, so tokens already handed out stay
+// valid until they expire.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+	retired bool
+}
+
+// KeyRing holds the keys used to sign and verify JWTs.
+// Exactly one key is active at a time; every token carries the `kid` of the
+// key that signed it so verifiers can pick the right public key.
+type KeyRing struct {
+	mu     sync.RWMutex
+	keys   map[string]*signingKey
+	active string
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: map[string]*signingKey{}}
+}
+
+// AddKey adds an Ed25519 or RSA private key under the given key ID.
+// The first key added becomes the active signing key.
+func (kr *KeyRing) AddKey(kid string, privateKey crypto.Signer) error {
+	if kid == "" {
+		return fmt.Errorf("key ID cannot be empty")
+	}
+
+	var method jwt.SigningMethod
+	switch key := privateKey.(type) {
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA key %s is too short: %d bits", kid, key.N.BitLen())
+		}
+		method = jwt.SigningMethodRS256
+	default:
+		return fmt.Errorf("unsupported key type %T for key %s", privateKey, kid)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, ok := kr.keys[kid]; ok {
+		return fmt.Errorf("key %s already exists", kid)
+	}
+
+	kr.keys[kid] = &signingKey{
+		id:      kid,
+		method:  method,
+		private: privateKey,
+		public:  privateKey.Public(),
+	}
+
+	if kr.active == "" {
+		kr.active = kid
+	}
+
+	return nil
+}
+
+// SetActive makes the given key the one used to sign new tokens.
+// Retired keys are on their way out and cannot sign again.
+func (kr *KeyRing) SetActive(kid string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	key, ok := kr.keys[kid]
+	if !ok {
+		return fmt.Errorf("key %s not found", kid)
+	}
+
+	if key.retired {
+		return fmt.Errorf("cannot activate the retired key %s", kid)
+	}
+
+	kr.active = kid
+	return nil
+}
+
+// Retire stops signing with the given key while still accepting it for
+// verification. The active key cannot be retired.
+func (kr *KeyRing) Retire(kid string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	key, ok := kr.keys[kid]
+	if !ok {
+		return fmt.Errorf("key %s not found", kid)
+	}
+
+	if kid == kr.active {
+		return fmt.Errorf("cannot retire the active key %s", kid)
+	}
+
+	key.retired = true
+	return nil
+}
+
+// Remove drops a key entirely; tokens signed with it no longer validate.
+func (kr *KeyRing) Remove(kid string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if kid == kr.active {
+		return fmt.Errorf("cannot remove the active key %s", kid)
+	}
+
+	delete(kr.keys, kid)
+	return nil
+}
+
+func (kr *KeyRing) activeKey() (*signingKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	key, ok := kr.keys[kr.active]
+	if !ok {
+		return nil, fmt.Errorf("key ring has no active signing key")
+	}
+
+	return key, nil
+}
+
+func (kr *KeyRing) lookup(kid string) (*signingKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	key, ok := kr.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	}
+
+	return key, nil
+}
+
+// sign signs the claims with the active key and sets the `kid` header.
+func (kr *KeyRing) sign(claims jwt.Claims) (string, error) {
+	key, err := kr.activeKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+
+	return token.SignedString(key.private)
+}
+
+// keyFunc resolves the verification key from the token's `kid` header and
+// makes sure the token was signed with the algorithm that key belongs to.
+func (kr *KeyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("token has no kid header")
+	}
+
+	key, err := kr.lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.public, nil
+}
+
+// JWK is the public part of a key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKey decodes the key for verifying signatures. Besides the Ed25519 and
+// RSA keys a KeyRing publishes, P-256 keys are understood, since identity
+// providers commonly sign with ES256.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported OKP curve %s", k.Curve)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key length %d", len(x))
+		}
+
+		return ed25519.PublicKey(x), nil
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported EC curve %s", k.Curve)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid P-256 key length")
+		}
+
+		// ecdh rejects points that are not on the curve
+		_, err = ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.KeyType)
+	}
+}
+
+// JWKS returns every key in the ring, active and retired, sorted by key ID.
+func (kr *KeyRing) JWKS() JWKS {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range kr.keys {
+		jwk := JWK{
+			KeyID:     key.id,
+			Algorithm: key.method.Alg(),
+			Use:       "sig",
+		}
+
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyID < set.Keys[j].KeyID
+	})
+
+	return set
+}
+
+// ParsePrivateKeyPEM parses a PKCS#8 (Ed25519 or RSA) or PKCS#1 (RSA) private key.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return signer, nil
+}
+
+// LoadKeyRing reads every `<kid>.pem` file in dir into a key ring.
+// The key named activeKID signs new tokens, all the others are retired.
+// activeKID may only be left empty when dir holds a single key.
+// To rotate, drop in a new key file, point activeKID at it, and delete the
+// old file once the tokens it signed have expired.
+func LoadKeyRing(dir, activeKID string) (*KeyRing, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .pem keys found in %s", dir)
+	}
+
+	// Otherwise the signing key would depend on the order of the files
+	if len(files) > 1 && activeKID == "" {
+		return nil, fmt.Errorf("%d keys found in %s but no active key ID given", len(files), dir)
+	}
+
+	kr := NewKeyRing()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ParsePrivateKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", file, err)
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		err = kr.AddKey(kid, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if activeKID != "" {
+		err = kr.SetActive(activeKID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for kid := range kr.keys {
+		if kid != kr.active {
+			kr.keys[kid].retired = true
+		}
+	}
+
+	return kr, nil
+}
+
+// NewEphemeralKeyRing generates a single Ed25519 key that only lives as long
+// as the process. Useful for local development; every restart logs users out.
+func NewEphemeralKeyRing() (*KeyRing, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	kr := NewKeyRing()
+	err = kr.AddKey("ephemeral", privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMakeAndValidateJWT(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+
+	keys := NewKeyRing()
+	if err := keys.AddKey("ed", edKey); err != nil {
+		t.Fatalf("Failed to add Ed25519 key: %v", err)
+	}
+	if err := keys.AddKey("rsa", rsaKey); err != nil {
+		t.Fatalf("Failed to add RSA key: %v", err)
+	}
+
+	userID := uuid.New()
+
+	for _, kid := range []string{"ed", "rsa"} {
+		if err := keys.SetActive(kid); err != nil {
+			t.Fatalf("Failed to activate key %s: %v", kid, err)
+		}
+
+		token, err := MakeJWT(userID, keys, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to make JWT with key %s: %v", kid, err)
+		}
+
+		got, err := ValidateJWT(token, keys)
+		if err != nil {
+			t.Fatalf("Failed to validate JWT signed with key %s: %v", kid, err)
+		}
+
+		if got != userID {
+			t.Fatalf("Expected user ID %s, got %s", userID, got)
+		}
+	}
+
+	expired, err := MakeJWT(userID, keys, -time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to make JWT: %v", err)
+	}
+
+	if _, err := ValidateJWT(expired, keys); err == nil {
+		t.Fatal("Expired JWT should not validate")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	keys := NewKeyRing()
+	if err := keys.AddKey("old", oldKey); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	userID := uuid.New()
+	inFlight, err := MakeJWT(userID, keys, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to make JWT: %v", err)
+	}
+
+	if err := keys.AddKey("new", newKey); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	if err := keys.SetActive("new"); err != nil {
+		t.Fatalf("Failed to activate key: %v", err)
+	}
+	if err := keys.Retire("old"); err != nil {
+		t.Fatalf("Failed to retire key: %v", err)
+	}
+
+	if _, err := ValidateJWT(inFlight, keys); err != nil {
+		t.Fatalf("Token signed with a retired key should still validate: %v", err)
+	}
+
+	if err := keys.SetActive("old"); err == nil {
+		t.Fatal("Retired key should not become active again")
+	}
+
+	if len(keys.JWKS().Keys) != 2 {
+		t.Fatalf("Expected both keys in the JWKS, got %d", len(keys.JWKS().Keys))
+	}
+
+	if err := keys.Remove("old"); err != nil {
+		t.Fatalf("Failed to remove key: %v", err)
+	}
+
+	if _, err := ValidateJWT(inFlight, keys); err == nil {
+		t.Fatal("Token signed with a removed key should not validate")
+	}
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, kid := range []string{"old", "new"} {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+	}
+
+	if _, err := LoadKeyRing(dir, ""); err == nil {
+		t.Fatal("Expected an error without an active key ID for several keys")
+	}
+
+	keys, err := LoadKeyRing(dir, "new")
+	if err != nil {
+		t.Fatalf("Failed to load key ring: %v", err)
+	}
+
+	token, err := MakeJWT(uuid.New(), keys, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to make JWT: %v", err)
+	}
+
+	if _, err := ValidateJWT(token, keys); err != nil {
+		t.Fatalf("Failed to validate JWT: %v", err)
+	}
+
+	if err := keys.SetActive("old"); err == nil {
+		t.Fatal("Keys other than the active one should be retired")
+	}
+}
+
+func TestJWKPublicKey(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+
+	keys := NewKeyRing()
+	if err := keys.AddKey("ed", edKey); err != nil {
+		t.Fatalf("Failed to add Ed25519 key: %v", err)
+	}
+	if err := keys.AddKey("rsa", rsaKey); err != nil {
+		t.Fatalf("Failed to add RSA key: %v", err)
+	}
+
+	want := map[string]crypto.PublicKey{
+		"ed":  edKey.Public(),
+		"rsa": rsaKey.Public(),
+	}
+
+	for _, jwk := range keys.JWKS().Keys {
+		got, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatalf("Failed to decode JWK %s: %v", jwk.KeyID, err)
+		}
+
+		if !want[jwk.KeyID].(interface{ Equal(crypto.PublicKey) bool }).Equal(got) {
+			t.Errorf("JWK %s decoded to a different key", jwk.KeyID)
+		}
+	}
+
+	_, err = JWK{KeyType: "EC", Curve: "P-256", X: "AAAA", Y: "AAAA"}.PublicKey()
+	if err == nil {
+		t.Errorf("Expected an error for an invalid P-256 point")
+	}
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateAccessToken(t *testing.T) {
+	keys, err := NewEphemeralKeyRing()
+	if err != nil {
+		t.Fatalf("Failed to create key ring: %v", err)
+	}
+
+	userID := uuid.New()
+	clientID := uuid.New()
+
+	loginToken, err := MakeJWT(userID, keys, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to make JWT: %v", err)
+	}
+
+	appToken, err := MakeScopedJWT(userID, keys, time.Hour, clientID, []string{ScopeChirpsWrite})
+	if err != nil {
+		t.Fatalf("Failed to make scoped JWT: %v", err)
+	}
+
+	noScopeToken, err := MakeScopedJWT(userID, keys, time.Hour, clientID, nil)
+	if err != nil {
+		t.Fatalf("Failed to make scoped JWT: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		token        string
+		wantClientID uuid.UUID
+		wantScopes   []string
+	}{
+		{
+			name:         "Login token is not limited",
+			token:        loginToken,
+			wantClientID: uuid.Nil,
+			wantScopes:   nil,
+		},
+		{
+			name:         "App token carries its scopes",
+			token:        appToken,
+			wantClientID: clientID,
+			wantScopes:   []string{ScopeChirpsWrite},
+		},
+		{
+			name:         "App token without scopes grants nothing",
+			token:        noScopeToken,
+			wantClientID: clientID,
+			wantScopes:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateAccessToken(tt.token, keys)
+			if err != nil {
+				t.Fatalf("ValidateAccessToken() error = %v", err)
+			}
+
+			if got.UserID != userID || got.ClientID != tt.wantClientID {
+				t.Errorf("ValidateAccessToken() = %+v", got)
+			}
+
+			if (got.Scopes == nil) != (tt.wantScopes == nil) || !slices.Equal(got.Scopes, tt.wantScopes) {
+				t.Errorf("Scopes = %#v, want %#v", got.Scopes, tt.wantScopes)
+			}
+		})
+	}
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if !VerifyCodeChallenge(verifier, challenge) {
+		t.Errorf("Expected the verifier to match its challenge")
+	}
+
+	if VerifyCodeChallenge("another-verifier", challenge) {
+		t.Errorf("Expected another verifier not to match")
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"net/http"
@@ -10,42 +11,23 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-	res, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+const accessAudience = "chirpy"
 
-	if err != nil {
-		return "", err
-	}
-
-	return string(res), nil
-}
-
-func CheckPasswordHash(hash, password string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// MakeJWT creates a new JWT token for the given user ID and secret.
+// MakeJWT creates a new JWT token for the given user ID.
 // In particular, in the token we put a user ID and an expiration date.
-// We further make sure the token is signed with the secret
-func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
-	secretKey := []byte(tokenSecret)
-
+// We further make sure the token is signed with the active key of the key ring
+func MakeJWT(userID uuid.UUID, keys *KeyRing, expiresIn time.Duration) (string, error) {
 	claims := jwt.RegisteredClaims{
 		Issuer:    "chirpy",
+		Audience:  jwt.ClaimStrings{accessAudience},
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   userID.String(),
 	}
-	res := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	jwt, err := res.SignedString(secretKey)
+
+	jwt, err := keys.sign(claims)
 
 	if err != nil {
 		return "", err
@@ -54,20 +36,21 @@ func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (str
 	return jwt, nil
 }
 
-// ValidateJWT checks if the token is valid and not expired.
-// In particular, we check if the token was signed with HS256 signing method.
+// ValidateJWT checks if the token is a valid access token and not expired.
+// In particular, we check that the token was signed by a key in the key ring,
+// using the algorithm of that key.
 // If everything is ok, we return the user ID from the token.
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claims := &jwt.RegisteredClaims{}
+func ValidateJWT(tokenString string, keys *KeyRing) (uuid.UUID, error) {
+	return validateJWTForAudience(tokenString, keys, accessAudience)
+}
 
-	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		if token.Method != jwt.SigningMethodHS256 {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(tokenSecret), nil
-	}
+func validateJWTForAudience(tokenString string, keys *KeyRing, audience string) (uuid.UUID, error) {
+	claims := &jwt.RegisteredClaims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.keyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodRS256.Alg()}),
+		jwt.WithAudience(audience),
+	)
 	if err != nil {
 		fmt.Printf("Token validation error: %v\n", err)
 		return uuid.Nil, err
@@ -105,6 +88,28 @@ func GetApiKey(headers http.Header) (string, error) {
 }
 
 func MakeRefreshToken() (string, error) {
+	return makeRandomToken()
+}
+
+// MakePasswordResetToken creates a single-use token that is mailed to a user
+// who forgot their password.
+func MakePasswordResetToken() (string, error) {
+	return makeRandomToken()
+}
+
+// MakeEmailVerificationToken creates a single-use token that is mailed to an
+// address to prove the user owns it.
+func MakeEmailVerificationToken() (string, error) {
+	return makeRandomToken()
+}
+
+// MakeCSRFToken creates the token a browser session echoes back in a header
+// on state-changing requests, proving the request came from our own pages.
+func MakeCSRFToken() (string, error) {
+	return makeRandomToken()
+}
+
+func makeRandomToken() (string, error) {
 	key := make([]byte, 32)
 	_, err := rand.Read(key)
 
@@ -115,3 +120,12 @@ func MakeRefreshToken() (string, error) {
 	token := hex.EncodeToString(key)
 	return token, nil
 }
+
+// HashToken returns the form in which an opaque token (refresh token,
+// password reset token, ...) is stored.
+// Only the SHA-256 digest is persisted, so a leaked database or backup
+// cannot be used to impersonate users.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
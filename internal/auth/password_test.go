@@ -32,3 +32,76 @@ func TestGetBearerToken(t *testing.T) {
 		t.Fatalf("Expected token %s, got %s", expectedToken, token)
 	}
 }
+
+func TestHashToken(t *testing.T) {
+	token, err := MakeRefreshToken()
+	if err != nil {
+		t.Fatalf("Failed to make refresh token: %v", err)
+	}
+
+	hashedToken := HashToken(token)
+
+	if hashedToken == token {
+		t.Fatal("Hashed token should not be the same as the original token")
+	}
+
+	if hashedToken != HashToken(token) {
+		t.Fatal("Hashing the same token twice should give the same result")
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	scopes, err := ValidateScopes([]string{ScopeChirpsWrite, ScopeChirpsWrite, ScopeProfileWrite})
+	if err != nil {
+		t.Fatalf("Known scopes should validate: %v", err)
+	}
+
+	if len(scopes) != 2 {
+		t.Fatalf("Expected duplicate scopes to be removed, got %v", scopes)
+	}
+
+	if _, err := ValidateScopes([]string{"admin"}); err == nil {
+		t.Fatal("Unknown scope should not validate")
+	}
+
+	if _, err := ValidateScopes(nil); err == nil {
+		t.Fatal("Empty scopes should not validate")
+	}
+}
+
+func TestMakePersonalAccessToken(t *testing.T) {
+	token, err := MakePersonalAccessToken()
+	if err != nil {
+		t.Fatalf("Failed to make personal access token: %v", err)
+	}
+
+	if !IsPersonalAccessToken(token) {
+		t.Fatalf("Expected %s to be recognized as a personal access token", token)
+	}
+
+	refreshToken, _ := MakeRefreshToken()
+	if IsPersonalAccessToken(refreshToken) {
+		t.Fatal("Refresh token should not be recognized as a personal access token")
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	cases := []struct {
+		role     Role
+		required Role
+		want     bool
+	}{
+		{RoleAdmin, RoleAdmin, true},
+		{RoleAdmin, RoleUser, true},
+		{RoleModerator, RoleUser, true},
+		{RoleModerator, RoleAdmin, false},
+		{RoleUser, RoleModerator, false},
+		{Role("superuser"), RoleUser, false},
+	}
+
+	for _, c := range cases {
+		if got := HasRole(c.role, c.required); got != c.want {
+			t.Fatalf("HasRole(%s, %s) = %v, want %v", c.role, c.required, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package auth
+
+import "fmt"
+
+// Role is the privilege level of a user. Each role includes the ones below it.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("unknown role: %s", s)
+	}
+
+	return role, nil
+}
+
+// HasRole reports whether a user with the given role may act as required.
+// Unknown roles have no privileges at all.
+func HasRole(role, required Role) bool {
+	rank, ok := roleRanks[role]
+	if !ok {
+		return false
+	}
+
+	return rank >= roleRanks[required]
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Scopes limit what a personal access token can do.
+// JWTs from a password login are not limited by scopes.
+const (
+	ScopeChirpsWrite  = "chirps:write"
+	ScopeChirpsDelete = "chirps:delete"
+	ScopeProfileWrite = "profile:write"
+	ScopeFollowsWrite = "follows:write"
+	ScopeLikesWrite   = "likes:write"
+)
+
+var AllScopes = []string{ScopeChirpsWrite, ScopeChirpsDelete, ScopeProfileWrite, ScopeFollowsWrite, ScopeLikesWrite}
+
+// personalAccessTokenPrefix tells personal access tokens apart from JWTs in
+// the Authorization header, and makes leaked tokens easy to grep for.
+const personalAccessTokenPrefix = "chirpy_pat_"
+
+// ValidateScopes checks that every scope is known and returns them deduplicated.
+func ValidateScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+
+	res := []string{}
+	for _, scope := range scopes {
+		if !slices.Contains(AllScopes, scope) {
+			return nil, fmt.Errorf("unknown scope: %s", scope)
+		}
+
+		if !slices.Contains(res, scope) {
+			res = append(res, scope)
+		}
+	}
+
+	return res, nil
+}
+
+// MakePersonalAccessToken creates a long-lived token for scripts and bots.
+// Like refresh tokens, only its HashToken digest is stored.
+func MakePersonalAccessToken() (string, error) {
+	token, err := makeRandomToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	return personalAccessTokenPrefix + token, nil
+}
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, personalAccessTokenPrefix)
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Number of 30 second steps accepted on either side of the current one,
+	// to make up for clock drift between the server and the phone
+	totpSkew = 1
+)
+
+const mfaAudience = "chirpy-mfa"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret creates a random 160 bit secret, base32 encoded as
+// authenticator apps expect it.
+func GenerateTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	_, err := rand.Read(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// TOTPURI builds the otpauth:// URI that authenticator apps read from a QR code.
+func TOTPURI(issuer, accountName, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + accountName)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the RFC 6238 code for the given time step.
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, see RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// ValidateTOTP checks a code against the secret at time t.
+// It returns the time step the code belongs to, so the caller can refuse
+// to accept the same step twice.
+func ValidateTOTP(secret, code string, t time.Time) (int64, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	current := t.Unix() / totpPeriod
+
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid TOTP code")
+}
+
+// GenerateRecoveryCodes creates n one-time codes like "k3j5a-9xq2m" that let
+// a user log in when they lost their authenticator.
+// They have enough entropy to be stored with HashToken.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+
+	for i := range codes {
+		key := make([]byte, 7)
+		_, err := rand.Read(key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(key))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
+
+// NormalizeRecoveryCode makes recovery codes case-insensitive before hashing.
+func NormalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// MakeMFAChallengeToken creates the short-lived token handed out after the
+// password step of a login for users with two-factor authentication.
+// It carries a different audience than access tokens, so ValidateJWT refuses it.
+func MakeMFAChallengeToken(userID uuid.UUID, keys *KeyRing, expiresIn time.Duration) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Issuer:    "chirpy",
+		Audience:  jwt.ClaimStrings{mfaAudience},
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+		Subject:   userID.String(),
+	}
+
+	return keys.sign(claims)
+}
+
+// ValidateMFAChallengeToken returns the user ID of a valid MFA challenge token.
+func ValidateMFAChallengeToken(tokenString string, keys *KeyRing) (uuid.UUID, error) {
+	return validateJWTForAudience(tokenString, keys, mfaAudience)
+}
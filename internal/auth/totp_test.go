@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateTOTP(t *testing.T) {
+	// Test vector from RFC 6238 appendix B, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	at := time.Unix(59, 0)
+
+	step, err := ValidateTOTP(secret, "287082", at)
+	if err != nil {
+		t.Fatalf("Expected RFC 6238 code to validate: %v", err)
+	}
+
+	if step != 1 {
+		t.Fatalf("Expected time step 1, got %d", step)
+	}
+
+	if _, err := ValidateTOTP(secret, "287082", at.Add(5*time.Minute)); err == nil {
+		t.Fatal("Code should not validate five minutes later")
+	}
+
+	if _, err := ValidateTOTP(secret, "000000", at); err == nil {
+		t.Fatal("Wrong code should not validate")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+
+	uri := TOTPURI("Chirpy", "user@example.com", secret)
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Chirpy:user@example.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatalf("Unexpected otpauth URI: %s", uri)
+	}
+}
+
+func TestMFAChallengeTokenIsNotAnAccessToken(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	keys := NewKeyRing()
+	if err := keys.AddKey("test", key); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	userID := uuid.New()
+	challenge, err := MakeMFAChallengeToken(userID, keys, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to make MFA challenge token: %v", err)
+	}
+
+	got, err := ValidateMFAChallengeToken(challenge, keys)
+	if err != nil || got != userID {
+		t.Fatalf("Expected challenge token for %s, got %s (%v)", userID, got, err)
+	}
+
+	if _, err := ValidateJWT(challenge, keys); err == nil {
+		t.Fatal("MFA challenge token should not be accepted as an access token")
+	}
+}
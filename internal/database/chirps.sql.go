@@ -7,48 +7,95 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 const createChirp = `-- name: CreateChirp :one
-INSERT INTO chirps (id, created_at, updated_at, body, user_id)
-VALUES (
-    gen_random_uuid(),
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, rechirp_of_id, quote_of_id)
+SELECT
+    new_chirp.id,
     NOW(),
     NOW(),
     $1,
-    $2
-)
-RETURNING id, created_at, updated_at, body, user_id
+    $2,
+    $3::UUID,
+    COALESCE((SELECT conversation_id FROM chirps WHERE chirps.id = $3::UUID), new_chirp.id),
+    $4::UUID,
+    $5::UUID
+FROM (SELECT gen_random_uuid() AS id) new_chirp
+RETURNING id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count
 `
 
 type CreateChirpParams struct {
-	Body   string
-	UserID uuid.UUID
+	Body        string
+	UserID      uuid.NullUUID
+	InReplyToID uuid.NullUUID
+	RechirpOfID uuid.NullUUID
+	QuoteOfID   uuid.NullUUID
+}
+
+type CreateChirpRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
 }
 
-func (q *Queries) CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp, error) {
-	row := q.db.QueryRowContext(ctx, createChirp, arg.Body, arg.UserID)
-	var i Chirp
+// A reply joins the conversation of the chirp it answers, any other chirp
+// starts its own.
+func (q *Queries) CreateChirp(ctx context.Context, arg CreateChirpParams) (CreateChirpRow, error) {
+	row := q.db.QueryRowContext(ctx, createChirp,
+		arg.Body,
+		arg.UserID,
+		arg.InReplyToID,
+		arg.RechirpOfID,
+		arg.QuoteOfID,
+	)
+	var i CreateChirpRow
 	err := row.Scan(
 		&i.ID,
 		&i.CreatedAt,
 		&i.UpdatedAt,
 		&i.Body,
 		&i.UserID,
+		&i.InReplyToID,
+		&i.ConversationID,
+		&i.DeletedAt,
+		&i.LikeCount,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
+		&i.RechirpCount,
+		&i.EditCount,
 	)
 	return i, err
 }
 
-const deleteChirpById = `-- name: DeleteChirpById :exec
+const deleteChirpById = `-- name: DeleteChirpById :execrows
 DELETE FROM chirps
 WHERE id = $1
+AND NOT EXISTS (SELECT 1 FROM chirps other WHERE other.in_reply_to_id = chirps.id OR other.quote_of_id = chirps.id)
 `
 
-func (q *Queries) DeleteChirpById(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, deleteChirpById, id)
-	return err
+// Chirps with replies or quotes are not deleted, see TombstoneChirp.
+func (q *Queries) DeleteChirpById(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteChirpById, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 const deleteChirps = `-- name: DeleteChirps :exec
@@ -60,26 +107,191 @@ func (q *Queries) DeleteChirps(ctx context.Context) error {
 	return err
 }
 
-const getAllChirps = `-- name: GetAllChirps :many
-SELECT id, created_at, updated_at, body, user_id FROM chirps
-ORDER BY created_at ASC
+const deleteChirpsByUserId = `-- name: DeleteChirpsByUserId :many
+DELETE FROM chirps
+WHERE user_id = $1
+AND NOT EXISTS (SELECT 1 FROM chirps other WHERE other.in_reply_to_id = chirps.id OR other.quote_of_id = chirps.id)
+RETURNING in_reply_to_id, quote_of_id
 `
 
-func (q *Queries) GetAllChirps(ctx context.Context) ([]Chirp, error) {
-	rows, err := q.db.QueryContext(ctx, getAllChirps)
+type DeleteChirpsByUserIdRow struct {
+	InReplyToID uuid.NullUUID
+	QuoteOfID   uuid.NullUUID
+}
+
+// Chirps with replies or quotes are not deleted, see TombstoneChirpsByUserId.
+// Returns what the deleted chirps replied to or quoted, see
+// DeleteUnreferencedTombstone.
+func (q *Queries) DeleteChirpsByUserId(ctx context.Context, userID uuid.NullUUID) ([]DeleteChirpsByUserIdRow, error) {
+	rows, err := q.db.QueryContext(ctx, deleteChirpsByUserId, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []Chirp
+	var items []DeleteChirpsByUserIdRow
 	for rows.Next() {
-		var i Chirp
+		var i DeleteChirpsByUserIdRow
+		if err := rows.Scan(&i.InReplyToID, &i.QuoteOfID); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const deleteRechirp = `-- name: DeleteRechirp :execrows
+DELETE FROM chirps
+WHERE user_id = $1 AND rechirp_of_id = $2
+`
+
+type DeleteRechirpParams struct {
+	UserID      uuid.NullUUID
+	RechirpOfID uuid.NullUUID
+}
+
+func (q *Queries) DeleteRechirp(ctx context.Context, arg DeleteRechirpParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteRechirp, arg.UserID, arg.RechirpOfID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteRechirpsByUserId = `-- name: DeleteRechirpsByUserId :exec
+DELETE FROM chirps
+WHERE user_id = $1 AND rechirp_of_id IS NOT NULL
+`
+
+func (q *Queries) DeleteRechirpsByUserId(ctx context.Context, userID uuid.NullUUID) error {
+	_, err := q.db.ExecContext(ctx, deleteRechirpsByUserId, userID)
+	return err
+}
+
+const deleteUnreferencedTombstone = `-- name: DeleteUnreferencedTombstone :one
+DELETE FROM chirps
+WHERE id = $1 AND deleted_at IS NOT NULL
+AND NOT EXISTS (SELECT 1 FROM chirps other WHERE other.in_reply_to_id = chirps.id OR other.quote_of_id = chirps.id)
+RETURNING in_reply_to_id, quote_of_id
+`
+
+type DeleteUnreferencedTombstoneRow struct {
+	InReplyToID uuid.NullUUID
+	QuoteOfID   uuid.NullUUID
+}
+
+// Deletes a tombstone once nothing replies to or quotes it anymore. Returns
+// what it replied to or quoted, which may be such a tombstone in turn.
+func (q *Queries) DeleteUnreferencedTombstone(ctx context.Context, id uuid.UUID) (DeleteUnreferencedTombstoneRow, error) {
+	row := q.db.QueryRowContext(ctx, deleteUnreferencedTombstone, id)
+	var i DeleteUnreferencedTombstoneRow
+	err := row.Scan(&i.InReplyToID, &i.QuoteOfID)
+	return i, err
+}
+
+const getChirp = `-- name: GetChirp :one
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE id = $1
+`
+
+type GetChirpRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+func (q *Queries) GetChirp(ctx context.Context, id uuid.UUID) (GetChirpRow, error) {
+	row := q.db.QueryRowContext(ctx, getChirp, id)
+	var i GetChirpRow
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+		&i.InReplyToID,
+		&i.ConversationID,
+		&i.DeletedAt,
+		&i.LikeCount,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
+		&i.RechirpCount,
+		&i.EditCount,
+	)
+	return i, err
+}
+
+const getChirpAncestors = `-- name: GetChirpAncestors :many
+WITH RECURSIVE ancestors AS (
+    SELECT parent.id, parent.in_reply_to_id, 1 AS distance
+    FROM chirps parent
+    JOIN chirps child ON child.in_reply_to_id = parent.id
+    WHERE child.id = $1
+    UNION ALL
+    SELECT chirps.id, chirps.in_reply_to_id, ancestors.distance + 1
+    FROM chirps
+    JOIN ancestors ON chirps.id = ancestors.in_reply_to_id
+)
+SELECT chirps.id, chirps.created_at, chirps.updated_at, chirps.body, chirps.user_id, chirps.in_reply_to_id, chirps.conversation_id, chirps.deleted_at, chirps.like_count, chirps.rechirp_of_id, chirps.quote_of_id, chirps.rechirp_count, chirps.edit_count FROM chirps
+JOIN ancestors ON chirps.id = ancestors.id
+ORDER BY ancestors.distance DESC
+`
+
+type GetChirpAncestorsRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+// The chirps the given chirp replies to, directly or not, root first.
+func (q *Queries) GetChirpAncestors(ctx context.Context, id uuid.UUID) ([]GetChirpAncestorsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpAncestors, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetChirpAncestorsRow
+	for rows.Next() {
+		var i GetChirpAncestorsRow
 		if err := rows.Scan(
 			&i.ID,
 			&i.CreatedAt,
 			&i.UpdatedAt,
 			&i.Body,
 			&i.UserID,
+			&i.InReplyToID,
+			&i.ConversationID,
+			&i.DeletedAt,
+			&i.LikeCount,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+			&i.RechirpCount,
+			&i.EditCount,
 		); err != nil {
 			return nil, err
 		}
@@ -94,45 +306,323 @@ func (q *Queries) GetAllChirps(ctx context.Context) ([]Chirp, error) {
 	return items, nil
 }
 
-const getChirp = `-- name: GetChirp :one
-SELECT id, created_at, updated_at, body, user_id FROM chirps
+const getChirpForUpdate = `-- name: GetChirpForUpdate :one
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
 WHERE id = $1
+FOR UPDATE
 `
 
-func (q *Queries) GetChirp(ctx context.Context, id uuid.UUID) (Chirp, error) {
-	row := q.db.QueryRowContext(ctx, getChirp, id)
-	var i Chirp
+type GetChirpForUpdateRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+// Locks the chirp until the end of the transaction, so edits don't race.
+func (q *Queries) GetChirpForUpdate(ctx context.Context, id uuid.UUID) (GetChirpForUpdateRow, error) {
+	row := q.db.QueryRowContext(ctx, getChirpForUpdate, id)
+	var i GetChirpForUpdateRow
 	err := row.Scan(
 		&i.ID,
 		&i.CreatedAt,
 		&i.UpdatedAt,
 		&i.Body,
 		&i.UserID,
+		&i.InReplyToID,
+		&i.ConversationID,
+		&i.DeletedAt,
+		&i.LikeCount,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
+		&i.RechirpCount,
+		&i.EditCount,
 	)
 	return i, err
 }
 
-const getChirpsByUserId = `-- name: GetChirpsByUserId :many
-SELECT id, created_at, updated_at, body, user_id FROM chirps
-WHERE user_id = $1
-ORDER BY created_at ASC
+const getChirpsByIds = `-- name: GetChirpsByIds :many
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE id = ANY($1::UUID[])
+`
+
+type GetChirpsByIdsRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+func (q *Queries) GetChirpsByIds(ctx context.Context, ids []uuid.UUID) ([]GetChirpsByIdsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpsByIds, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetChirpsByIdsRow
+	for rows.Next() {
+		var i GetChirpsByIdsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.InReplyToID,
+			&i.ConversationID,
+			&i.DeletedAt,
+			&i.LikeCount,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+			&i.RechirpCount,
+			&i.EditCount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listChirps = `-- name: ListChirps :many
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE deleted_at IS NULL
+AND ($1::UUID IS NULL OR user_id = $1::UUID)
+AND ($1::UUID IS NOT NULL OR rechirp_of_id IS NULL)
+AND ($2::TIMESTAMP IS NULL
+    OR (created_at, id) > ($2::TIMESTAMP, $3::UUID))
+ORDER BY created_at ASC, id ASC
+LIMIT $4
+`
+
+type ListChirpsParams struct {
+	AuthorID       uuid.NullUUID
+	AfterCreatedAt sql.NullTime
+	AfterID        uuid.NullUUID
+	PageSize       int32
+}
+
+type ListChirpsRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+func (q *Queries) ListChirps(ctx context.Context, arg ListChirpsParams) ([]ListChirpsRow, error) {
+	rows, err := q.db.QueryContext(ctx, listChirps,
+		arg.AuthorID,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListChirpsRow
+	for rows.Next() {
+		var i ListChirpsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.InReplyToID,
+			&i.ConversationID,
+			&i.DeletedAt,
+			&i.LikeCount,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+			&i.RechirpCount,
+			&i.EditCount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listChirpsDesc = `-- name: ListChirpsDesc :many
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE deleted_at IS NULL
+AND ($1::UUID IS NULL OR user_id = $1::UUID)
+AND ($1::UUID IS NOT NULL OR rechirp_of_id IS NULL)
+AND ($2::TIMESTAMP IS NULL
+    OR (created_at, id) < ($2::TIMESTAMP, $3::UUID))
+ORDER BY created_at DESC, id DESC
+LIMIT $4
+`
+
+type ListChirpsDescParams struct {
+	AuthorID        uuid.NullUUID
+	BeforeCreatedAt sql.NullTime
+	BeforeID        uuid.NullUUID
+	PageSize        int32
+}
+
+type ListChirpsDescRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+func (q *Queries) ListChirpsDesc(ctx context.Context, arg ListChirpsDescParams) ([]ListChirpsDescRow, error) {
+	rows, err := q.db.QueryContext(ctx, listChirpsDesc,
+		arg.AuthorID,
+		arg.BeforeCreatedAt,
+		arg.BeforeID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListChirpsDescRow
+	for rows.Next() {
+		var i ListChirpsDescRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.InReplyToID,
+			&i.ConversationID,
+			&i.DeletedAt,
+			&i.LikeCount,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+			&i.RechirpCount,
+			&i.EditCount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listConversationReplies = `-- name: ListConversationReplies :many
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE conversation_id = $1 AND id <> $1
+AND ($2::TIMESTAMP IS NULL
+    OR (created_at, id) > ($2::TIMESTAMP, $3::UUID))
+ORDER BY created_at ASC, id ASC
+LIMIT $4
 `
 
-func (q *Queries) GetChirpsByUserId(ctx context.Context, userID uuid.UUID) ([]Chirp, error) {
-	rows, err := q.db.QueryContext(ctx, getChirpsByUserId, userID)
+type ListConversationRepliesParams struct {
+	RootID         uuid.UUID
+	AfterCreatedAt sql.NullTime
+	AfterID        uuid.NullUUID
+	PageSize       int32
+}
+
+type ListConversationRepliesRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+// Every reply in the thread started by the root chirp, oldest first. A reply
+// is always newer than the chirp it answers, so parents come before their
+// replies, across pages too.
+func (q *Queries) ListConversationReplies(ctx context.Context, arg ListConversationRepliesParams) ([]ListConversationRepliesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listConversationReplies,
+		arg.RootID,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.PageSize,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []Chirp
+	var items []ListConversationRepliesRow
 	for rows.Next() {
-		var i Chirp
+		var i ListConversationRepliesRow
 		if err := rows.Scan(
 			&i.ID,
 			&i.CreatedAt,
 			&i.UpdatedAt,
 			&i.Body,
 			&i.UserID,
+			&i.InReplyToID,
+			&i.ConversationID,
+			&i.DeletedAt,
+			&i.LikeCount,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+			&i.RechirpCount,
+			&i.EditCount,
 		); err != nil {
 			return nil, err
 		}
@@ -146,3 +636,247 @@ func (q *Queries) GetChirpsByUserId(ctx context.Context, userID uuid.UUID) ([]Ch
 	}
 	return items, nil
 }
+
+const listDescendantReplies = `-- name: ListDescendantReplies :many
+WITH RECURSIVE descendants AS (
+    SELECT chirps.id FROM chirps
+    WHERE chirps.in_reply_to_id = $1
+    UNION ALL
+    SELECT chirps.id FROM chirps
+    JOIN descendants ON chirps.in_reply_to_id = descendants.id
+)
+SELECT chirps.id, chirps.created_at, chirps.updated_at, chirps.body, chirps.user_id, chirps.in_reply_to_id, chirps.conversation_id, chirps.deleted_at, chirps.like_count, chirps.rechirp_of_id, chirps.quote_of_id, chirps.rechirp_count, chirps.edit_count FROM chirps
+JOIN descendants ON chirps.id = descendants.id
+WHERE $2::TIMESTAMP IS NULL
+    OR (chirps.created_at, chirps.id) > ($2::TIMESTAMP, $3::UUID)
+ORDER BY chirps.created_at ASC, chirps.id ASC
+LIMIT $4
+`
+
+type ListDescendantRepliesParams struct {
+	ChirpID        uuid.UUID
+	AfterCreatedAt sql.NullTime
+	AfterID        uuid.NullUUID
+	PageSize       int32
+}
+
+type ListDescendantRepliesRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+// Like ListConversationReplies, for a chirp in the middle of a thread.
+func (q *Queries) ListDescendantReplies(ctx context.Context, arg ListDescendantRepliesParams) ([]ListDescendantRepliesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listDescendantReplies,
+		arg.ChirpID,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDescendantRepliesRow
+	for rows.Next() {
+		var i ListDescendantRepliesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.InReplyToID,
+			&i.ConversationID,
+			&i.DeletedAt,
+			&i.LikeCount,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+			&i.RechirpCount,
+			&i.EditCount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const searchChirps = `-- name: SearchChirps :many
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count,
+    ts_headline('english', body, query,
+        'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', MaxFragments=2, MinWords=5, MaxWords=20')::TEXT AS snippet,
+    score
+FROM (
+    SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count, query,
+        ts_rank_cd(search_vector, query, 32)::FLOAT8 + EXTRACT(EPOCH FROM created_at)::FLOAT8 / 2592000 AS score
+    FROM chirps, to_tsquery('english', $1) query
+    WHERE search_vector @@ query
+) ranked
+WHERE $2::FLOAT8 IS NULL
+    OR (score, id) < ($2::FLOAT8, $3::UUID)
+ORDER BY score DESC, id DESC
+LIMIT $4
+`
+
+type SearchChirpsParams struct {
+	Query       string
+	BeforeScore sql.NullFloat64
+	BeforeID    uuid.NullUUID
+	PageSize    int32
+}
+
+type SearchChirpsRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+	Snippet        string
+	Score          float64
+}
+
+// Relevance is combined with recency: a perfect match ranks like a weak one
+// about 30 days newer. The score doesn't depend on the current time, so
+// cursors over it stay valid.
+func (q *Queries) SearchChirps(ctx context.Context, arg SearchChirpsParams) ([]SearchChirpsRow, error) {
+	rows, err := q.db.QueryContext(ctx, searchChirps,
+		arg.Query,
+		arg.BeforeScore,
+		arg.BeforeID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SearchChirpsRow
+	for rows.Next() {
+		var i SearchChirpsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.InReplyToID,
+			&i.ConversationID,
+			&i.LikeCount,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+			&i.RechirpCount,
+			&i.EditCount,
+			&i.Snippet,
+			&i.Score,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const tombstoneChirp = `-- name: TombstoneChirp :execrows
+UPDATE chirps
+SET body = '', deleted_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+`
+
+func (q *Queries) TombstoneChirp(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, tombstoneChirp, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const tombstoneChirpsByUserId = `-- name: TombstoneChirpsByUserId :exec
+UPDATE chirps
+SET body = '', deleted_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND deleted_at IS NULL
+AND EXISTS (SELECT 1 FROM chirps other WHERE other.in_reply_to_id = chirps.id OR other.quote_of_id = chirps.id)
+`
+
+func (q *Queries) TombstoneChirpsByUserId(ctx context.Context, userID uuid.NullUUID) error {
+	_, err := q.db.ExecContext(ctx, tombstoneChirpsByUserId, userID)
+	return err
+}
+
+const updateChirpBody = `-- name: UpdateChirpBody :one
+UPDATE chirps
+SET body = $2, updated_at = NOW(), edit_count = edit_count + 1
+WHERE id = $1
+RETURNING id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count
+`
+
+type UpdateChirpBodyParams struct {
+	ID   uuid.UUID
+	Body string
+}
+
+type UpdateChirpBodyRow struct {
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+func (q *Queries) UpdateChirpBody(ctx context.Context, arg UpdateChirpBodyParams) (UpdateChirpBodyRow, error) {
+	row := q.db.QueryRowContext(ctx, updateChirpBody, arg.ID, arg.Body)
+	var i UpdateChirpBodyRow
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+		&i.InReplyToID,
+		&i.ConversationID,
+		&i.DeletedAt,
+		&i.LikeCount,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
+		&i.RechirpCount,
+		&i.EditCount,
+	)
+	return i, err
+}
@@ -12,27 +12,160 @@ import (
 )
 
 type Chirp struct {
-	ID        uuid.UUID
+	ID             uuid.UUID
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Body           string
+	UserID         uuid.NullUUID
+	SearchVector   interface{}
+	InReplyToID    uuid.NullUUID
+	ConversationID uuid.UUID
+	DeletedAt      sql.NullTime
+	LikeCount      int32
+	RechirpOfID    uuid.NullUUID
+	QuoteOfID      uuid.NullUUID
+	RechirpCount   int32
+	EditCount      int32
+}
+
+type ChirpRevision struct {
+	ID         uuid.UUID
+	ChirpID    uuid.UUID
+	Body       string
+	CreatedAt  time.Time
+	ReplacedAt time.Time
+}
+
+type EmailVerificationToken struct {
+	TokenHash string
 	CreatedAt time.Time
-	UpdatedAt time.Time
-	Body      string
 	UserID    uuid.UUID
+	Email     string
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
 }
 
-type RefreshToken struct {
-	Token     string
+type Follow struct {
+	FollowerID uuid.UUID
+	FolloweeID uuid.UUID
+	CreatedAt  time.Time
+}
+
+type Like struct {
+	UserID    uuid.UUID
+	ChirpID   uuid.UUID
+	CreatedAt time.Time
+}
+
+type LoginThrottle struct {
+	Key            string
+	FailedAttempts int32
+	LastFailedAt   time.Time
+	LockedUntil    sql.NullTime
+}
+
+type MfaRecoveryCode struct {
+	CodeHash  string
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	UsedAt    sql.NullTime
+}
+
+type OauthAuthorizationCode struct {
+	CodeHash      string
+	CreatedAt     time.Time
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	RedirectUri   string
+	Scopes        []string
+	CodeChallenge string
+	ExpiresAt     time.Time
+	UsedAt        sql.NullTime
+	FamilyID      uuid.NullUUID
+}
+
+type OauthClient struct {
+	ID           uuid.UUID
+	CreatedAt    time.Time
+	UserID       uuid.UUID
+	Name         string
+	SecretHash   sql.NullString
+	RedirectUris []string
+	Scopes       []string
+}
+
+type OidcLoginState struct {
+	StateHash    string
+	CreatedAt    time.Time
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	UserID       uuid.NullUUID
+	UseCookies   bool
+	ExpiresAt    time.Time
+}
+
+type PasswordResetToken struct {
+	TokenHash string
 	CreatedAt time.Time
-	UpdatedAt time.Time
 	UserID    uuid.UUID
 	ExpiresAt time.Time
-	RevokedAt sql.NullTime
+	UsedAt    sql.NullTime
+}
+
+type PersonalAccessToken struct {
+	ID         uuid.UUID
+	CreatedAt  time.Time
+	UserID     uuid.UUID
+	Name       string
+	TokenHash  string
+	Scopes     []string
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+type RefreshToken struct {
+	TokenHash       string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	UserID          uuid.UUID
+	ExpiresAt       time.Time
+	RevokedAt       sql.NullTime
+	FamilyID        uuid.UUID
+	ParentTokenHash sql.NullString
+	UserAgent       string
+	IpAddress       string
+	LastUsedAt      time.Time
+	ClientID        uuid.NullUUID
+	Scopes          []string
 }
 
 type User struct {
-	ID             uuid.UUID
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Email          string
-	HashedPassword string
-	IsChirpyRed    sql.NullBool
+	ID               uuid.UUID
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Email            string
+	HashedPassword   string
+	IsChirpyRed      sql.NullBool
+	EmailVerifiedAt  sql.NullTime
+	PendingEmail     sql.NullString
+	TotpSecret       sql.NullString
+	TotpEnabledAt    sql.NullTime
+	TotpLastUsedStep sql.NullInt64
+	Role             string
+	DeletedAt        sql.NullTime
+	Handle           string
+	DisplayName      string
+	Bio              string
+	AvatarUrl        string
+}
+
+type UserIdentity struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	Provider  string
+	Subject   string
+	Email     string
 }
@@ -7,38 +7,70 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 const createRefreshToken = `-- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, user_id, expires_at, revoked_at)
+INSERT INTO refresh_tokens (token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id, parent_token_hash, user_agent, ip_address, last_used_at, client_id, scopes)
 VALUES (
     $1,
     NOW(),
     NOW(),
     $2,
     NOW() + INTERVAL '60 days',
-    null
+    null,
+    $3,
+    $4,
+    $5,
+    $6,
+    NOW(),
+    $7,
+    $8
 )
-RETURNING token, created_at, updated_at, user_id, expires_at, revoked_at
+RETURNING token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id, parent_token_hash, user_agent, ip_address, last_used_at, client_id, scopes
 `
 
 type CreateRefreshTokenParams struct {
-	Token  string
-	UserID uuid.UUID
+	TokenHash       string
+	UserID          uuid.UUID
+	FamilyID        uuid.UUID
+	ParentTokenHash sql.NullString
+	UserAgent       string
+	IpAddress       string
+	ClientID        uuid.NullUUID
+	Scopes          []string
 }
 
 func (q *Queries) CreateRefreshToken(ctx context.Context, arg CreateRefreshTokenParams) (RefreshToken, error) {
-	row := q.db.QueryRowContext(ctx, createRefreshToken, arg.Token, arg.UserID)
+	row := q.db.QueryRowContext(ctx, createRefreshToken,
+		arg.TokenHash,
+		arg.UserID,
+		arg.FamilyID,
+		arg.ParentTokenHash,
+		arg.UserAgent,
+		arg.IpAddress,
+		arg.ClientID,
+		pq.Array(arg.Scopes),
+	)
 	var i RefreshToken
 	err := row.Scan(
-		&i.Token,
+		&i.TokenHash,
 		&i.CreatedAt,
 		&i.UpdatedAt,
 		&i.UserID,
 		&i.ExpiresAt,
 		&i.RevokedAt,
+		&i.FamilyID,
+		&i.ParentTokenHash,
+		&i.UserAgent,
+		&i.IpAddress,
+		&i.LastUsedAt,
+		&i.ClientID,
+		pq.Array(&i.Scopes),
 	)
 	return i, err
 }
@@ -54,37 +86,298 @@ func (q *Queries) DeleteRefreshToken(ctx context.Context) error {
 
 const getRefreshToken = `-- name: GetRefreshToken :one
 SELECT 
-    token, 
+    token_hash, 
     created_at, 
     updated_at, 
     user_id, 
     expires_at,
-    revoked_at
+    revoked_at,
+    family_id,
+    parent_token_hash,
+    user_agent,
+    ip_address,
+    last_used_at,
+    client_id,
+    scopes
 FROM refresh_tokens 
-WHERE token = $1
+WHERE token_hash = $1
 `
 
-func (q *Queries) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
-	row := q.db.QueryRowContext(ctx, getRefreshToken, token)
+func (q *Queries) GetRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	row := q.db.QueryRowContext(ctx, getRefreshToken, tokenHash)
 	var i RefreshToken
 	err := row.Scan(
-		&i.Token,
+		&i.TokenHash,
 		&i.CreatedAt,
 		&i.UpdatedAt,
 		&i.UserID,
 		&i.ExpiresAt,
 		&i.RevokedAt,
+		&i.FamilyID,
+		&i.ParentTokenHash,
+		&i.UserAgent,
+		&i.IpAddress,
+		&i.LastUsedAt,
+		&i.ClientID,
+		pq.Array(&i.Scopes),
 	)
 	return i, err
 }
 
+const getRefreshTokenForUpdate = `-- name: GetRefreshTokenForUpdate :one
+SELECT 
+    token_hash, 
+    created_at, 
+    updated_at, 
+    user_id, 
+    expires_at,
+    revoked_at,
+    family_id,
+    parent_token_hash,
+    user_agent,
+    ip_address,
+    last_used_at,
+    client_id,
+    scopes
+FROM refresh_tokens 
+WHERE token_hash = $1
+FOR UPDATE
+`
+
+func (q *Queries) GetRefreshTokenForUpdate(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	row := q.db.QueryRowContext(ctx, getRefreshTokenForUpdate, tokenHash)
+	var i RefreshToken
+	err := row.Scan(
+		&i.TokenHash,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.UserID,
+		&i.ExpiresAt,
+		&i.RevokedAt,
+		&i.FamilyID,
+		&i.ParentTokenHash,
+		&i.UserAgent,
+		&i.IpAddress,
+		&i.LastUsedAt,
+		&i.ClientID,
+		pq.Array(&i.Scopes),
+	)
+	return i, err
+}
+
+const listActiveSessionsByUserId = `-- name: ListActiveSessionsByUserId :many
+SELECT family_id, user_agent, ip_address, last_used_at, expires_at, started_at
+FROM (
+    SELECT
+        rt.family_id,
+        rt.user_agent,
+        rt.ip_address,
+        rt.last_used_at,
+        rt.expires_at,
+        (SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = rt.family_id)::TIMESTAMP AS started_at
+    FROM refresh_tokens rt
+    WHERE rt.user_id = $1 AND rt.client_id IS NULL AND rt.revoked_at IS NULL AND rt.expires_at > NOW()
+) sessions
+WHERE $2::TIMESTAMP IS NULL
+    OR (started_at, family_id) < ($2::TIMESTAMP, $3::UUID)
+ORDER BY started_at DESC, family_id DESC
+LIMIT $4
+`
+
+type ListActiveSessionsByUserIdParams struct {
+	UserID          uuid.UUID
+	BeforeStartedAt sql.NullTime
+	BeforeID        uuid.NullUUID
+	PageSize        int32
+}
+
+type ListActiveSessionsByUserIdRow struct {
+	FamilyID   uuid.UUID
+	UserAgent  string
+	IpAddress  string
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	StartedAt  time.Time
+}
+
+// Newest sessions first. Pages go by start time, which unlike the last use
+// doesn't change while a client pages through.
+func (q *Queries) ListActiveSessionsByUserId(ctx context.Context, arg ListActiveSessionsByUserIdParams) ([]ListActiveSessionsByUserIdRow, error) {
+	rows, err := q.db.QueryContext(ctx, listActiveSessionsByUserId,
+		arg.UserID,
+		arg.BeforeStartedAt,
+		arg.BeforeID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListActiveSessionsByUserIdRow
+	for rows.Next() {
+		var i ListActiveSessionsByUserIdRow
+		if err := rows.Scan(
+			&i.FamilyID,
+			&i.UserAgent,
+			&i.IpAddress,
+			&i.LastUsedAt,
+			&i.ExpiresAt,
+			&i.StartedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listAuthorizedClientsByUserId = `-- name: ListAuthorizedClientsByUserId :many
+SELECT id, name, authorized_at, last_used_at
+FROM (
+    SELECT
+        c.id,
+        c.name,
+        MIN(f.created_at)::TIMESTAMP AS authorized_at,
+        MAX(f.last_used_at)::TIMESTAMP AS last_used_at
+    FROM refresh_tokens f
+    JOIN oauth_clients c ON c.id = f.client_id
+    WHERE f.user_id = $1
+    AND f.family_id IN (
+        SELECT rt.family_id FROM refresh_tokens rt
+        WHERE rt.user_id = $1 AND rt.client_id IS NOT NULL AND rt.revoked_at IS NULL AND rt.expires_at > NOW()
+    )
+    GROUP BY c.id, c.name
+) apps
+WHERE $2::TIMESTAMP IS NULL
+    OR (authorized_at, id) < ($2::TIMESTAMP, $3::UUID)
+ORDER BY authorized_at DESC, id DESC
+LIMIT $4
+`
+
+type ListAuthorizedClientsByUserIdParams struct {
+	UserID             uuid.UUID
+	BeforeAuthorizedAt sql.NullTime
+	BeforeID           uuid.NullUUID
+	PageSize           int32
+}
+
+type ListAuthorizedClientsByUserIdRow struct {
+	ID           uuid.UUID
+	Name         string
+	AuthorizedAt time.Time
+	LastUsedAt   time.Time
+}
+
+// Most recently authorized apps first. An app was authorized when the oldest
+// of its grants still in use began: the first token of a family with an active
+// token, however many rotations ago. Unlike refreshes, this doesn't move while
+// a client pages through.
+func (q *Queries) ListAuthorizedClientsByUserId(ctx context.Context, arg ListAuthorizedClientsByUserIdParams) ([]ListAuthorizedClientsByUserIdRow, error) {
+	rows, err := q.db.QueryContext(ctx, listAuthorizedClientsByUserId,
+		arg.UserID,
+		arg.BeforeAuthorizedAt,
+		arg.BeforeID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListAuthorizedClientsByUserIdRow
+	for rows.Next() {
+		var i ListAuthorizedClientsByUserIdRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.AuthorizedAt,
+			&i.LastUsedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const revokeClientAuthorization = `-- name: RevokeClientAuthorization :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE client_id = $1 AND user_id = $2 AND revoked_at IS NULL
+`
+
+type RevokeClientAuthorizationParams struct {
+	ClientID uuid.NullUUID
+	UserID   uuid.UUID
+}
+
+func (q *Queries) RevokeClientAuthorization(ctx context.Context, arg RevokeClientAuthorizationParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeClientAuthorization, arg.ClientID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const revokeRefreshToken = `-- name: RevokeRefreshToken :exec
 UPDATE refresh_tokens
 SET revoked_at = NOW(), updated_at = NOW()
-WHERE token = $1
+WHERE token_hash = $1
+`
+
+func (q *Queries) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+	_, err := q.db.ExecContext(ctx, revokeRefreshToken, tokenHash)
+	return err
+}
+
+const revokeRefreshTokenFamily = `-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1 AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeRefreshTokenFamily, familyID)
+	return err
+}
+
+const revokeRefreshTokensByUserId = `-- name: RevokeRefreshTokensByUserId :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL
 `
 
-func (q *Queries) RevokeRefreshToken(ctx context.Context, token string) error {
-	_, err := q.db.ExecContext(ctx, revokeRefreshToken, token)
+func (q *Queries) RevokeRefreshTokensByUserId(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeRefreshTokensByUserId, userID)
 	return err
 }
+
+const revokeUserSession = `-- name: RevokeUserSession :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1 AND user_id = $2 AND client_id IS NULL AND revoked_at IS NULL
+`
+
+type RevokeUserSessionParams struct {
+	FamilyID uuid.UUID
+	UserID   uuid.UUID
+}
+
+func (q *Queries) RevokeUserSession(ctx context.Context, arg RevokeUserSessionParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeUserSession, arg.FamilyID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -7,29 +7,34 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 const createUser = `-- name: CreateUser :one
-INSERT INTO users (id, created_at, updated_at, email, hashed_password)
+INSERT INTO users (id, created_at, updated_at, email, hashed_password, handle)
 VALUES (
     gen_random_uuid(),
     NOW(),
     NOW(),
     $1,
-    $2
+    $2,
+    $3
 )
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, pending_email, totp_secret, totp_enabled_at, totp_last_used_step, role, deleted_at, handle, display_name, bio, avatar_url
 `
 
 type CreateUserParams struct {
 	Email          string
 	HashedPassword string
+	Handle         string
 }
 
 func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, error) {
-	row := q.db.QueryRowContext(ctx, createUser, arg.Email, arg.HashedPassword)
+	row := q.db.QueryRowContext(ctx, createUser, arg.Email, arg.HashedPassword, arg.Handle)
 	var i User
 	err := row.Scan(
 		&i.ID,
@@ -38,21 +43,55 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.PendingEmail,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastUsedStep,
+		&i.Role,
+		&i.DeletedAt,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
 	)
 	return i, err
 }
 
-const deleteUsers = `-- name: DeleteUsers :exec
+const deleteOtherUsers = `-- name: DeleteOtherUsers :exec
 DELETE FROM users
+WHERE id <> $1
 `
 
-func (q *Queries) DeleteUsers(ctx context.Context) error {
-	_, err := q.db.ExecContext(ctx, deleteUsers)
+func (q *Queries) DeleteOtherUsers(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, deleteOtherUsers, id)
+	return err
+}
+
+const disableUserTOTP = `-- name: DisableUserTOTP :exec
+UPDATE users
+SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_used_step = NULL, updated_at = NOW()
+WHERE id = $1
+`
+
+func (q *Queries) DisableUserTOTP(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, disableUserTOTP, id)
+	return err
+}
+
+const enableUserTOTP = `-- name: EnableUserTOTP :exec
+UPDATE users
+SET totp_enabled_at = NOW(), updated_at = NOW()
+WHERE id = $1
+`
+
+func (q *Queries) EnableUserTOTP(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, enableUserTOTP, id)
 	return err
 }
 
 const getUserByEmail = `-- name: GetUserByEmail :one
-SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red FROM users
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, pending_email, totp_secret, totp_enabled_at, totp_last_used_step, role, deleted_at, handle, display_name, bio, avatar_url FROM users
 WHERE email = $1
 `
 
@@ -66,12 +105,83 @@ func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.PendingEmail,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastUsedStep,
+		&i.Role,
+		&i.DeletedAt,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
+	)
+	return i, err
+}
+
+const getUserByHandle = `-- name: GetUserByHandle :one
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, pending_email, totp_secret, totp_enabled_at, totp_last_used_step, role, deleted_at, handle, display_name, bio, avatar_url FROM users
+WHERE LOWER(handle) = LOWER($1)
+`
+
+func (q *Queries) GetUserByHandle(ctx context.Context, handle string) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByHandle, handle)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.PendingEmail,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastUsedStep,
+		&i.Role,
+		&i.DeletedAt,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
+	)
+	return i, err
+}
+
+const getUserById = `-- name: GetUserById :one
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, pending_email, totp_secret, totp_enabled_at, totp_last_used_step, role, deleted_at, handle, display_name, bio, avatar_url FROM users
+WHERE id = $1
+`
+
+func (q *Queries) GetUserById(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserById, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.PendingEmail,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastUsedStep,
+		&i.Role,
+		&i.DeletedAt,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
 	)
 	return i, err
 }
 
 const getUserFromRefreshToken = `-- name: GetUserFromRefreshToken :one
-SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red FROM users
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, pending_email, totp_secret, totp_enabled_at, totp_last_used_step, role, deleted_at, handle, display_name, bio, avatar_url FROM users
 WHERE id = $1
 `
 
@@ -85,13 +195,263 @@ func (q *Queries) GetUserFromRefreshToken(ctx context.Context, id uuid.UUID) (Us
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.PendingEmail,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastUsedStep,
+		&i.Role,
+		&i.DeletedAt,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
+	)
+	return i, err
+}
+
+const getUserProfilesByIds = `-- name: GetUserProfilesByIds :many
+SELECT id, handle, display_name, avatar_url FROM users
+WHERE id = ANY($1::UUID[]) AND deleted_at IS NULL
+`
+
+type GetUserProfilesByIdsRow struct {
+	ID          uuid.UUID
+	Handle      string
+	DisplayName string
+	AvatarUrl   string
+}
+
+func (q *Queries) GetUserProfilesByIds(ctx context.Context, ids []uuid.UUID) ([]GetUserProfilesByIdsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getUserProfilesByIds, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetUserProfilesByIdsRow
+	for rows.Next() {
+		var i GetUserProfilesByIdsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Handle,
+			&i.DisplayName,
+			&i.AvatarUrl,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUsersDueForPurge = `-- name: ListUsersDueForPurge :many
+SELECT id FROM users
+WHERE deleted_at < $1::TIMESTAMP
+`
+
+func (q *Queries) ListUsersDueForPurge(ctx context.Context, cutoff time.Time) ([]uuid.UUID, error) {
+	rows, err := q.db.QueryContext(ctx, listUsersDueForPurge, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const lockUserForPurge = `-- name: LockUserForPurge :one
+SELECT id FROM users
+WHERE id = $1 AND deleted_at < $2::TIMESTAMP
+FOR UPDATE
+`
+
+type LockUserForPurgeParams struct {
+	ID     uuid.UUID
+	Cutoff time.Time
+}
+
+// Locks a user due for purging, so a restore has to wait for the purge or
+// the purge sees the restore.
+func (q *Queries) LockUserForPurge(ctx context.Context, arg LockUserForPurgeParams) (uuid.UUID, error) {
+	row := q.db.QueryRowContext(ctx, lockUserForPurge, arg.ID, arg.Cutoff)
+	var id uuid.UUID
+	err := row.Scan(&id)
+	return id, err
+}
+
+const purgeUser = `-- name: PurgeUser :execrows
+DELETE FROM users
+WHERE id = $1 AND deleted_at < $2::TIMESTAMP
+`
+
+type PurgeUserParams struct {
+	ID     uuid.UUID
+	Cutoff time.Time
+}
+
+func (q *Queries) PurgeUser(ctx context.Context, arg PurgeUserParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, purgeUser, arg.ID, arg.Cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const rehashUserPassword = `-- name: RehashUserPassword :exec
+UPDATE users
+SET hashed_password = $1
+WHERE id = $2 AND hashed_password = $3
+`
+
+type RehashUserPasswordParams struct {
+	NewHash string
+	ID      uuid.UUID
+	OldHash string
+}
+
+func (q *Queries) RehashUserPassword(ctx context.Context, arg RehashUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, rehashUserPassword, arg.NewHash, arg.ID, arg.OldHash)
+	return err
+}
+
+const restoreUser = `-- name: RestoreUser :execrows
+UPDATE users
+SET deleted_at = NULL, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NOT NULL
+`
+
+func (q *Queries) RestoreUser(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, restoreUser, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const scheduleUserDeletion = `-- name: ScheduleUserDeletion :one
+UPDATE users
+SET deleted_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, pending_email, totp_secret, totp_enabled_at, totp_last_used_step, role, deleted_at, handle, display_name, bio, avatar_url
+`
+
+func (q *Queries) ScheduleUserDeletion(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, scheduleUserDeletion, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.PendingEmail,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastUsedStep,
+		&i.Role,
+		&i.DeletedAt,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
 	)
 	return i, err
 }
 
+const setUserPendingEmail = `-- name: SetUserPendingEmail :exec
+UPDATE users
+SET pending_email = $2, updated_at = NOW()
+WHERE id = $1
+`
+
+type SetUserPendingEmailParams struct {
+	ID           uuid.UUID
+	PendingEmail sql.NullString
+}
+
+func (q *Queries) SetUserPendingEmail(ctx context.Context, arg SetUserPendingEmailParams) error {
+	_, err := q.db.ExecContext(ctx, setUserPendingEmail, arg.ID, arg.PendingEmail)
+	return err
+}
+
+const setUserRoleByEmail = `-- name: SetUserRoleByEmail :execrows
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE email = $1
+`
+
+type SetUserRoleByEmailParams struct {
+	Email string
+	Role  string
+}
+
+func (q *Queries) SetUserRoleByEmail(ctx context.Context, arg SetUserRoleByEmailParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setUserRoleByEmail, arg.Email, arg.Role)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setUserRoleById = `-- name: SetUserRoleById :execrows
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE id = $1
+`
+
+type SetUserRoleByIdParams struct {
+	ID   uuid.UUID
+	Role string
+}
+
+func (q *Queries) SetUserRoleById(ctx context.Context, arg SetUserRoleByIdParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setUserRoleById, arg.ID, arg.Role)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setUserTOTPSecret = `-- name: SetUserTOTPSecret :exec
+UPDATE users
+SET totp_secret = $2, totp_enabled_at = NULL, totp_last_used_step = NULL, updated_at = NOW()
+WHERE id = $1
+`
+
+type SetUserTOTPSecretParams struct {
+	ID         uuid.UUID
+	TotpSecret sql.NullString
+}
+
+func (q *Queries) SetUserTOTPSecret(ctx context.Context, arg SetUserTOTPSecretParams) error {
+	_, err := q.db.ExecContext(ctx, setUserTOTPSecret, arg.ID, arg.TotpSecret)
+	return err
+}
+
 const updateUserById = `-- name: UpdateUserById :exec
 UPDATE users 
-SET email = $2, hashed_password = $3
+SET email = $2, hashed_password = $3, updated_at = NOW()
 WHERE id = $1
 `
 
@@ -116,3 +476,100 @@ func (q *Queries) UpdateUserChirpyRedById(ctx context.Context, id uuid.UUID) err
 	_, err := q.db.ExecContext(ctx, updateUserChirpyRedById, id)
 	return err
 }
+
+const updateUserPasswordById = `-- name: UpdateUserPasswordById :exec
+UPDATE users
+SET hashed_password = $2, updated_at = NOW()
+WHERE id = $1
+`
+
+type UpdateUserPasswordByIdParams struct {
+	ID             uuid.UUID
+	HashedPassword string
+}
+
+func (q *Queries) UpdateUserPasswordById(ctx context.Context, arg UpdateUserPasswordByIdParams) error {
+	_, err := q.db.ExecContext(ctx, updateUserPasswordById, arg.ID, arg.HashedPassword)
+	return err
+}
+
+const updateUserProfile = `-- name: UpdateUserProfile :one
+UPDATE users
+SET handle = $2, display_name = $3, bio = $4, avatar_url = $5, updated_at = NOW()
+WHERE id = $1
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, pending_email, totp_secret, totp_enabled_at, totp_last_used_step, role, deleted_at, handle, display_name, bio, avatar_url
+`
+
+type UpdateUserProfileParams struct {
+	ID          uuid.UUID
+	Handle      string
+	DisplayName string
+	Bio         string
+	AvatarUrl   string
+}
+
+func (q *Queries) UpdateUserProfile(ctx context.Context, arg UpdateUserProfileParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, updateUserProfile,
+		arg.ID,
+		arg.Handle,
+		arg.DisplayName,
+		arg.Bio,
+		arg.AvatarUrl,
+	)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.PendingEmail,
+		&i.TotpSecret,
+		&i.TotpEnabledAt,
+		&i.TotpLastUsedStep,
+		&i.Role,
+		&i.DeletedAt,
+		&i.Handle,
+		&i.DisplayName,
+		&i.Bio,
+		&i.AvatarUrl,
+	)
+	return i, err
+}
+
+const useUserTOTPStep = `-- name: UseUserTOTPStep :execrows
+UPDATE users
+SET totp_last_used_step = $2
+WHERE id = $1 AND (totp_last_used_step IS NULL OR totp_last_used_step < $2)
+`
+
+type UseUserTOTPStepParams struct {
+	ID               uuid.UUID
+	TotpLastUsedStep sql.NullInt64
+}
+
+func (q *Queries) UseUserTOTPStep(ctx context.Context, arg UseUserTOTPStepParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, useUserTOTPStep, arg.ID, arg.TotpLastUsedStep)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const verifyUserEmail = `-- name: VerifyUserEmail :exec
+UPDATE users
+SET email = $2, email_verified_at = NOW(), pending_email = NULL, updated_at = NOW()
+WHERE id = $1
+`
+
+type VerifyUserEmailParams struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) VerifyUserEmail(ctx context.Context, arg VerifyUserEmailParams) error {
+	_, err := q.db.ExecContext(ctx, verifyUserEmail, arg.ID, arg.Email)
+	return err
+}
@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := FileMailer{Dir: dir}
+
+	err := m.Send(context.Background(), Message{
+		To:      "user@example.com",
+		Subject: "Hello",
+		Body:    "Hello from Chirpy",
+	})
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one message file, got %v (%v)", files, err)
+	}
+
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message file: %v", err)
+	}
+
+	if !strings.Contains(string(content), "To: user@example.com") || !strings.Contains(string(content), "Hello from Chirpy") {
+		t.Fatalf("Unexpected message content: %s", content)
+	}
+}
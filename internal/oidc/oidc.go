@@ -0,0 +1,330 @@
+// Package oidc implements the relying party side of the OpenID Connect
+// authorization code flow with PKCE, for signing in with external identity providers.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Config describes an identity provider registered with us as a client.
+type Config struct {
+	// Name identifies the provider in our URLs and in user identities
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+// discoveryDocument holds the parts of the issuer's metadata we use.
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one OpenID Connect issuer. The issuer's metadata and
+// keys are fetched on first use and cached, so starting the server doesn't
+// depend on the identity provider being reachable.
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discoveryDocument
+	keys      map[string]crypto.PublicKey
+}
+
+// Claims are the ID token claims we care about.
+type Claims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func NewProvider(config Config, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email"}
+	}
+
+	return &Provider{Config: config, client: client}
+}
+
+// LoadProviders reads a JSON array of provider configurations, keyed by name.
+func LoadProviders(path string, client *http.Client) (map[string]*Provider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := []Config{}
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	providers := map[string]*Provider{}
+	for _, config := range configs {
+		if config.Name == "" || config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+			return nil, fmt.Errorf("provider %q needs a name, issuer, client_id and redirect_url", config.Name)
+		}
+
+		if _, ok := providers[config.Name]; ok {
+			return nil, fmt.Errorf("provider %s is configured twice", config.Name)
+		}
+
+		providers[config.Name] = NewProvider(config, client)
+	}
+
+	return providers, nil
+}
+
+// NewState creates the value that ties the authorization response to the
+// request we started.
+func NewState() (string, error) {
+	return randomString()
+}
+
+// NewNonce creates the value the issuer echoes in the ID token, so a token
+// can't be replayed into another login.
+func NewNonce() (string, error) {
+	return randomString()
+}
+
+// NewCodeVerifier creates a PKCE code verifier (RFC 7636).
+func NewCodeVerifier() (string, error) {
+	return randomString()
+}
+
+// CodeChallenge derives the S256 code challenge sent with the authorization request.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL returns the URL to send the user to for signing in.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	return authURL.String(), nil
+}
+
+// Exchange redeems an authorization code and returns the claims of the
+// verified ID token that came with it.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Claims, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic, which every provider has to support (RFC 6749 section 2.3.1)
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	tokenResponse := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
+	}
+
+	if tokenResponse.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	return p.verifyIDToken(ctx, discovery, tokenResponse.IDToken, nonce)
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, discovery *discoveryDocument, rawIDToken, nonce string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, discovery, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+
+	return claims, nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	discovery := &discoveryDocument{}
+	err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", discovery)
+	if err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", p.Issuer, err)
+	}
+
+	// The metadata must be about the issuer we asked (OpenID Connect Discovery section 4.3)
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %s, not %s", discovery.Issuer, p.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document for %s is incomplete", p.Issuer)
+	}
+
+	p.discovery = discovery
+	return discovery, nil
+}
+
+// publicKey returns the issuer's key with the given ID. The key set is
+// fetched again on a miss, which picks up keys the issuer has rotated in.
+func (p *Provider) publicKey(ctx context.Context, discovery *discoveryDocument, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	set := auth.JWKS{}
+	err := p.getJSON(ctx, discovery.JWKSURI, &set)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys of %s: %w", p.Issuer, err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.PublicKey()
+		if err != nil {
+			// Skip keys we don't understand rather than failing on all of them
+			continue
+		}
+
+		keys[jwk.KeyID] = key
+	}
+	p.keys = keys
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	}
+
+	return key, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
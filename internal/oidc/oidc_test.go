@@ -0,0 +1,143 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/oidc/oidctest"
+)
+
+const redirectURL = "http://localhost:8080/api/oidc/stub/callback"
+
+// authorize runs the browser's part of the flow against the stub issuer
+// and returns the code and state it redirects back with.
+func authorize(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("Authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected a redirect from the authorization endpoint, got %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect: %v", err)
+	}
+
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func newStubProvider(t *testing.T) (*oidctest.Issuer, *Provider) {
+	t.Helper()
+
+	issuer, err := oidctest.NewIssuer("chirpy", "secret")
+	if err != nil {
+		t.Fatalf("Failed to start stub issuer: %v", err)
+	}
+	t.Cleanup(issuer.Close)
+
+	provider := NewProvider(Config{
+		Name:         "stub",
+		Issuer:       issuer.URL,
+		ClientID:     "chirpy",
+		ClientSecret: "secret",
+		RedirectURL:  redirectURL,
+	}, issuer.Client())
+
+	return issuer, provider
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	issuer, provider := newStubProvider(t)
+	issuer.SetUser(oidctest.User{Subject: "alice-123", Email: "alice@example.com", EmailVerified: true})
+
+	ctx := context.Background()
+	verifier, _ := NewCodeVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, "the-state", "the-nonce", CodeChallenge(verifier))
+	if err != nil {
+		t.Fatalf("AuthCodeURL failed: %v", err)
+	}
+
+	code, state := authorize(t, authURL)
+	if state != "the-state" {
+		t.Errorf("Expected state to round trip, got %q", state)
+	}
+
+	claims, err := provider.Exchange(ctx, code, verifier, "the-nonce")
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+
+	if claims.Subject != "alice-123" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	_, err = provider.Exchange(ctx, code, verifier, "the-nonce")
+	if err == nil {
+		t.Errorf("Expected a redeemed code to be rejected")
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier func(verifier string) string
+		nonce    string
+	}{
+		{
+			name:     "Wrong code verifier",
+			verifier: func(string) string { return "not-the-verifier" },
+			nonce:    "the-nonce",
+		},
+		{
+			name:     "Wrong nonce",
+			verifier: func(verifier string) string { return verifier },
+			nonce:    "another-nonce",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, provider := newStubProvider(t)
+
+			ctx := context.Background()
+			verifier, _ := NewCodeVerifier()
+
+			authURL, err := provider.AuthCodeURL(ctx, "the-state", "the-nonce", CodeChallenge(verifier))
+			if err != nil {
+				t.Fatalf("AuthCodeURL failed: %v", err)
+			}
+
+			code, _ := authorize(t, authURL)
+
+			_, err = provider.Exchange(ctx, code, tt.verifier(verifier), tt.nonce)
+			if err == nil {
+				t.Errorf("Expected the exchange to fail")
+			}
+		})
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if got != want {
+		t.Errorf("CodeChallenge() = %s, want %s", got, want)
+	}
+}
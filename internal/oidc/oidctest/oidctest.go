@@ -0,0 +1,212 @@
+// Package oidctest runs a stub OpenID Connect issuer on a local port, so the
+// sign-in flow can be exercised without a real identity provider or network access.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "oidctest"
+
+// User is who signs in at the stub's authorization endpoint.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// Issuer is a stub identity provider with a single registered client. Its
+// authorization endpoint doesn't show a login page: it signs in the current
+// User right away and redirects back with a code.
+type Issuer struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	key  *rsa.PrivateKey
+	keys *auth.KeyRing
+
+	mu    sync.Mutex
+	user  User
+	codes map[string]authorization
+}
+
+// authorization is an issued code waiting to be redeemed.
+type authorization struct {
+	user          User
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+}
+
+// NewIssuer starts a stub issuer. Close it when done.
+func NewIssuer(clientID, clientSecret string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := auth.NewKeyRing()
+	err = keys.AddKey(keyID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := &Issuer{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		keys:         keys,
+		user:         User{Subject: "stub-user", Email: "stub-user@example.com", EmailVerified: true},
+		codes:        map[string]authorization{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.discoveryHandler)
+	mux.HandleFunc("GET /authorize", issuer.authorizeHandler)
+	mux.HandleFunc("POST /token", issuer.tokenHandler)
+	mux.HandleFunc("GET /jwks", issuer.jwksHandler)
+	issuer.Server = httptest.NewServer(mux)
+
+	return issuer, nil
+}
+
+// SetUser changes who signs in next.
+func (iss *Issuer) SetUser(user User) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	iss.user = user
+}
+
+func (iss *Issuer) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]string{
+		"issuer":                 iss.URL,
+		"authorization_endpoint": iss.URL + "/authorize",
+		"token_endpoint":         iss.URL + "/token",
+		"jwks_uri":               iss.URL + "/jwks",
+	})
+}
+
+func (iss *Issuer) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, iss.keys.JWKS())
+}
+
+func (iss *Issuer) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if query.Get("client_id") != iss.ClientID || query.Get("response_type") != "code" {
+		http.Error(w, "invalid authorization request", 400)
+		return
+	}
+
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", 400)
+		return
+	}
+
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", 400)
+		return
+	}
+
+	code := rand.Text()
+
+	iss.mu.Lock()
+	iss.codes[code] = authorization{
+		user:          iss.user,
+		redirectURI:   redirectURI.String(),
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	iss.mu.Unlock()
+
+	callback := redirectURI.Query()
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	redirectURI.RawQuery = callback.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (iss *Issuer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	if clientID != iss.ClientID || clientSecret != iss.ClientSecret {
+		writeJSON(w, 401, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeJSON(w, 400, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	// Codes are single use, even when the exchange fails
+	iss.mu.Lock()
+	authz, ok := iss.codes[r.PostFormValue("code")]
+	delete(iss.codes, r.PostFormValue("code"))
+	iss.mu.Unlock()
+
+	if !ok || authz.redirectURI != r.PostFormValue("redirect_uri") {
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != authz.codeChallenge {
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            iss.URL,
+		"sub":            authz.user.Subject,
+		"aud":            iss.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          authz.nonce,
+		"email":          authz.user.Email,
+		"email_verified": authz.user.EmailVerified,
+	})
+	token.Header["kid"] = keyID
+
+	idToken, err := token.SignedString(iss.key)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, 200, map[string]interface{}{
+		"access_token": rand.Text(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
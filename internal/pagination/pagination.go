@@ -0,0 +1,128 @@
+// Package pagination implements keyset pagination with opaque cursors.
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor points at the last item of a page. Items are ordered by a timestamp,
+// or by Score for search results, with the ID breaking ties. A cursor stays
+// valid when items are added.
+type Cursor struct {
+	CreatedAt time.Time
+	Score     float64
+	ID        uuid.UUID
+}
+
+type encodedCursor struct {
+	// Microseconds since the epoch, the precision of Postgres timestamps
+	CreatedAt int64     `json:"t,omitempty"`
+	Score     float64   `json:"s,omitempty"`
+	ID        uuid.UUID `json:"id"`
+}
+
+// Encode returns the cursor as an opaque string for clients.
+func (c Cursor) Encode() string {
+	encoded := encodedCursor{Score: c.Score, ID: c.ID}
+	if !c.CreatedAt.IsZero() {
+		encoded.CreatedAt = c.CreatedAt.UnixMicro()
+	}
+
+	raw, _ := json.Marshal(encoded)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Decode parses a cursor made by Encode.
+func Decode(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	var encoded encodedCursor
+	err = json.Unmarshal(raw, &encoded)
+	if err != nil || encoded.ID == uuid.Nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	cursor := Cursor{Score: encoded.Score, ID: encoded.ID}
+	if encoded.CreatedAt != 0 {
+		cursor.CreatedAt = time.UnixMicro(encoded.CreatedAt).UTC()
+	}
+
+	return cursor, nil
+}
+
+// Page is what a client asked for with the cursor and limit query parameters.
+type Page struct {
+	// nil for the first page
+	After *Cursor
+	Limit int
+}
+
+// FromQuery reads the page from the query string.
+func FromQuery(query url.Values) (Page, error) {
+	page := Page{Limit: DefaultLimit}
+
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			return Page{}, fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+		}
+
+		page.Limit = limit
+	}
+
+	if s := query.Get("cursor"); s != "" {
+		cursor, err := Decode(s)
+		if err != nil {
+			return Page{}, err
+		}
+
+		page.After = &cursor
+	}
+
+	return page, nil
+}
+
+// Cut cuts items fetched with a limit of page.Limit+1 down to the page. It
+// returns the cursor of the next page, or "" if this is the last one.
+func Cut[T any](items []T, page Page, cursorOf func(T) Cursor) ([]T, string) {
+	if len(items) <= page.Limit {
+		return items, ""
+	}
+
+	items = items[:page.Limit]
+	return items, cursorOf(items[len(items)-1]).Encode()
+}
+
+// SetNextLink points the client to the next page with a Link header
+// (RFC 8288). The link is the request URL with the cursor replaced, so
+// filters and the sort order carry over.
+func SetNextLink(h http.Header, requestURL *url.URL, next string) {
+	if next == "" {
+		return
+	}
+
+	query := requestURL.Query()
+	query.Set("cursor", next)
+
+	link := url.URL{Path: requestURL.Path, RawQuery: query.Encode()}
+	h.Set("Link", fmt.Sprintf(`<%s>; rel="next"`, link.String()))
+}
@@ -0,0 +1,131 @@
+package pagination
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor Cursor
+	}{
+		{
+			name:   "Timestamp",
+			cursor: Cursor{CreatedAt: time.Date(2025, 3, 14, 15, 9, 26, 535897000, time.UTC), ID: uuid.New()},
+		},
+		{
+			name:   "Score",
+			cursor: Cursor{Score: 672.4193548387097, ID: uuid.New()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.cursor.Encode())
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+
+			if !got.CreatedAt.Equal(tt.cursor.CreatedAt) || got.Score != tt.cursor.Score || got.ID != tt.cursor.ID {
+				t.Errorf("Decode() = %+v, want %+v", got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []string{
+		"not base64!",
+		"bm90IGpzb24",  // "not json"
+		"eyJ0IjoxMjN9", // {"t":123} without an ID
+	}
+
+	for _, s := range tests {
+		_, err := Decode(s)
+		if err != ErrInvalidCursor {
+			t.Errorf("Decode(%q) error = %v, want ErrInvalidCursor", s, err)
+		}
+	}
+}
+
+func TestFromQuery(t *testing.T) {
+	cursor := Cursor{CreatedAt: time.Now().UTC().Truncate(time.Microsecond), ID: uuid.New()}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantLimit int
+		wantAfter bool
+		wantErr   bool
+	}{
+		{name: "Defaults", query: "", wantLimit: DefaultLimit},
+		{name: "Limit and cursor", query: "limit=5&cursor=" + cursor.Encode(), wantLimit: 5, wantAfter: true},
+		{name: "Limit too large", query: "limit=1000", wantErr: true},
+		{name: "Limit zero", query: "limit=0", wantErr: true},
+		{name: "Invalid cursor", query: "cursor=abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+
+			page, err := FromQuery(query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if page.Limit != tt.wantLimit || (page.After != nil) != tt.wantAfter {
+				t.Errorf("FromQuery() = %+v", page)
+			}
+
+			if tt.wantAfter && page.After.ID != cursor.ID {
+				t.Errorf("After = %+v, want %+v", page.After, cursor)
+			}
+		})
+	}
+}
+
+func TestCut(t *testing.T) {
+	page := Page{Limit: 2}
+	cursorOf := func(i int) Cursor {
+		return Cursor{CreatedAt: time.Unix(int64(i), 0).UTC(), ID: uuid.Nil}
+	}
+
+	items, next := Cut([]int{1, 2, 3}, page, cursorOf)
+	if len(items) != 2 || next != cursorOf(2).Encode() {
+		t.Errorf("Cut() = %v, %q", items, next)
+	}
+
+	items, next = Cut([]int{1, 2}, page, cursorOf)
+	if len(items) != 2 || next != "" {
+		t.Errorf("Cut() = %v, %q", items, next)
+	}
+}
+
+func TestSetNextLink(t *testing.T) {
+	requestURL, _ := url.Parse("/api/chirps?sort=desc&cursor=old&limit=5")
+
+	h := http.Header{}
+	SetNextLink(h, requestURL, "new")
+
+	want := `</api/chirps?cursor=new&limit=5&sort=desc>; rel="next"`
+	if got := h.Get("Link"); got != want {
+		t.Errorf("Link = %s, want %s", got, want)
+	}
+
+	h = http.Header{}
+	SetNextLink(h, requestURL, "")
+
+	if got := h.Get("Link"); got != "" {
+		t.Errorf("Expected no Link header on the last page, got %s", got)
+	}
+}
@@ -0,0 +1,88 @@
+// Package search turns user input into PostgreSQL full-text queries and
+// formats the matches Postgres highlights.
+package search
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// MaxQueryLength bounds the q parameter, longer queries are rejected.
+const MaxQueryLength = 256
+
+var ErrEmptyQuery = errors.New("search query has no words")
+
+// Markers ts_headline puts around matches. Being control characters, they
+// survive HTML escaping, and at worst a stray one in a chirp becomes an
+// unmatched <mark>, never other markup.
+const (
+	StartMarker = "\x02"
+	StopMarker  = "\x03"
+)
+
+// ParseQuery converts a search box query into to_tsquery syntax. Words must
+// all match, "quoted words" must match as a phrase, and a word ending in *
+// matches as a prefix. Anything else is treated as text, so users can't
+// inject tsquery operators.
+func ParseQuery(q string) (string, error) {
+	terms := []string{}
+
+	for i, part := range strings.Split(q, `"`) {
+		// Every other part is inside quotes
+		if i%2 == 1 {
+			if term := phrase(words(part), false); term != "" {
+				terms = append(terms, term)
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			prefix := strings.HasSuffix(field, "*")
+
+			if term := phrase(words(field), prefix); term != "" {
+				terms = append(terms, term)
+			}
+		}
+	}
+
+	if len(terms) == 0 {
+		return "", ErrEmptyQuery
+	}
+
+	return strings.Join(terms, " & "), nil
+}
+
+// words splits s into lowercase runs of letters and digits.
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// phrase joins words that must follow each other, like Postgres does for
+// "it's" or "e-mail" in the chirps themselves.
+func phrase(words []string, prefix bool) string {
+	if len(words) == 0 {
+		return ""
+	}
+
+	if prefix {
+		words[len(words)-1] += ":*"
+	}
+
+	if len(words) == 1 {
+		return words[0]
+	}
+
+	return "(" + strings.Join(words, " <-> ") + ")"
+}
+
+// Highlight escapes a ts_headline snippet for HTML and wraps the matches in
+// <mark> tags.
+func Highlight(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, StartMarker, "<mark>")
+	return strings.ReplaceAll(escaped, StopMarker, "</mark>")
+}
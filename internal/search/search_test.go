@@ -0,0 +1,44 @@
+package search
+
+import "testing"
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		q       string
+		want    string
+		wantErr bool
+	}{
+		{name: "Words", q: "Hello world", want: "hello & world"},
+		{name: "Phrase", q: `"hello world" chirpy`, want: "(hello <-> world) & chirpy"},
+		{name: "Prefix", q: "chirp*", want: "chirp:*"},
+		{name: "Word with punctuation", q: "e-mail", want: "(e <-> mail)"},
+		{name: "Operators are text", q: "cats | !dogs & (birds:*)", want: "cats & dogs & birds"},
+		{name: "Unterminated quote", q: `"hello world`, want: "(hello <-> world)"},
+		{name: "Unicode", q: "Café", want: "café"},
+		{name: "Empty", q: "  ", wantErr: true},
+		{name: "Only punctuation", q: `"" ! *`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseQuery(tt.q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("ParseQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	snippet := "<b>" + StartMarker + "chirpy" + StopMarker + " & more"
+	want := "&lt;b&gt;<mark>chirpy</mark> &amp; more"
+
+	if got := Highlight(snippet); got != want {
+		t.Errorf("Highlight() = %q, want %q", got, want)
+	}
+}
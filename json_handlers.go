@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/ValentinoFilipetto/chirpy/internal/auth"
 	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type errorVals struct {
@@ -18,11 +22,17 @@ type errorVals struct {
 }
 
 type User struct {
-	ID          uuid.UUID `json:"id"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	Email       string    `json:"email"`
-	IsChirpyRed bool      `json:"is_chirpy_red"`
+	ID              uuid.UUID `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	Email           string    `json:"email"`
+	Handle          string    `json:"handle"`
+	DisplayName     string    `json:"display_name"`
+	Bio             string    `json:"bio"`
+	AvatarURL       string    `json:"avatar_url"`
+	IsChirpyRed     bool      `json:"is_chirpy_red"`
+	IsEmailVerified bool      `json:"is_email_verified"`
+	Role            string    `json:"role"`
 }
 
 type Chirp struct {
@@ -30,7 +40,122 @@ type Chirp struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Body      string    `json:"body"`
-	UserID    uuid.UUID `json:"user_id"`
+	// null once the author's account has been purged
+	UserID         *uuid.UUID `json:"user_id"`
+	InReplyToID    *uuid.UUID `json:"in_reply_to_id"`
+	ConversationID uuid.UUID  `json:"conversation_id"`
+	LikeCount      int32      `json:"like_count"`
+	LikedByMe      bool       `json:"liked_by_me"`
+	// Set on a rechirp, which has no body of its own
+	RechirpOfID *uuid.UUID `json:"rechirp_of_id"`
+	// Set on a quote chirp
+	QuoteOfID    *uuid.UUID `json:"quote_of_id"`
+	RechirpCount int32      `json:"rechirp_count"`
+	// Earlier bodies are listed at /api/chirps/{chirpID}/revisions
+	Edited    bool  `json:"edited"`
+	EditCount int32 `json:"edit_count"`
+	// The chirp shared by a rechirp or quoted by a quote, one level deep
+	RechirpOf *Chirp `json:"rechirp_of,omitempty"`
+	Quoted    *Chirp `json:"quoted,omitempty"`
+	// A deleted chirp that still has replies or quotes, without body or author
+	Deleted bool `json:"deleted,omitempty"`
+	// Only with ?embed=author
+	Author *Author `json:"author,omitempty"`
+}
+
+func toUser(user database.User) User {
+	return User{
+		ID:              user.ID,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+		Email:           user.Email,
+		Handle:          user.Handle,
+		DisplayName:     user.DisplayName,
+		Bio:             user.Bio,
+		AvatarURL:       user.AvatarUrl,
+		IsChirpyRed:     user.IsChirpyRed.Valid && user.IsChirpyRed.Bool,
+		IsEmailVerified: user.EmailVerifiedAt.Valid,
+		Role:            user.Role,
+	}
+}
+
+func nullUUIDPtr(u uuid.NullUUID) *uuid.UUID {
+	if !u.Valid {
+		return nil
+	}
+
+	return &u.UUID
+}
+
+// chirpRow is any query result that carries a whole chirp. Chirp queries
+// leave out search_vector, so sqlc gives each of them a row type of its own,
+// all with the same fields.
+type chirpRow interface {
+	database.CreateChirpRow | database.GetChirpRow | database.GetChirpAncestorsRow |
+		database.GetChirpForUpdateRow | database.GetChirpsByIdsRow | database.GetTimelineRow |
+		database.ListChirpsRow | database.ListChirpsDescRow | database.ListConversationRepliesRow |
+		database.ListDescendantRepliesRow | database.UpdateChirpBodyRow
+}
+
+func toChirp[T chirpRow](row T) Chirp {
+	chirp := database.GetChirpRow(row)
+
+	if chirp.DeletedAt.Valid {
+		return Chirp{
+			ID:             chirp.ID,
+			CreatedAt:      chirp.CreatedAt,
+			UpdatedAt:      chirp.UpdatedAt,
+			InReplyToID:    nullUUIDPtr(chirp.InReplyToID),
+			ConversationID: chirp.ConversationID,
+			Deleted:        true,
+		}
+	}
+
+	return Chirp{
+		ID:             chirp.ID,
+		CreatedAt:      chirp.CreatedAt,
+		UpdatedAt:      chirp.UpdatedAt,
+		Body:           chirp.Body,
+		UserID:         nullUUIDPtr(chirp.UserID),
+		InReplyToID:    nullUUIDPtr(chirp.InReplyToID),
+		ConversationID: chirp.ConversationID,
+		LikeCount:      chirp.LikeCount,
+		RechirpOfID:    nullUUIDPtr(chirp.RechirpOfID),
+		QuoteOfID:      nullUUIDPtr(chirp.QuoteOfID),
+		RechirpCount:   chirp.RechirpCount,
+		Edited:         chirp.EditCount > 0,
+		EditCount:      chirp.EditCount,
+	}
+}
+
+// prepareChirps fills in what chirp responses carry besides the rows: the
+// chirps shared or quoted, whether the caller liked each chirp and, with
+// ?embed=author, the authors.
+func (cfg *apiConfig) prepareChirps(r *http.Request, chirps []Chirp) error {
+	originals, err := cfg.embedOriginals(r.Context(), chirps)
+
+	if err != nil {
+		return err
+	}
+
+	// The originals are embedded by pointer, so they can be filled in afterwards
+	for _, batch := range [][]Chirp{chirps, originals} {
+		err = cfg.markLikedChirps(r.Context(), batch)
+
+		if err != nil {
+			return err
+		}
+
+		if wantsEmbed(r, "author") {
+			err = cfg.embedAuthors(r.Context(), batch)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 // Handler for JSON responses
@@ -61,6 +186,27 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 	w.Write(dat)
 }
 
+const maxChirpLength = 140
+
+var (
+	errChirpTooLong = errors.New("Chirp is too long")
+	errEmptyQuote   = errors.New("A quote needs a body, rechirp to share without one")
+)
+
+// validateChirpBody checks the body of a new or edited chirp and returns it
+// ready to store. A quote needs text of its own, or it would be a rechirp.
+func validateChirpBody(body string, isQuote bool) (string, error) {
+	if len(body) > maxChirpLength {
+		return "", errChirpTooLong
+	}
+
+	if isQuote && strings.TrimSpace(body) == "" {
+		return "", errEmptyQuote
+	}
+
+	return badWorldReplacement(body), nil
+}
+
 func badWorldReplacement(str string) string {
 	profaneWords := []string{"kerfuffle", "sharbert", "fornax"}
 	words := strings.Split(str, " ")
@@ -81,6 +227,7 @@ func (cfg *apiConfig) CreateUserHandler(w http.ResponseWriter, r *http.Request)
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Handle   string `json:"handle"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -92,6 +239,16 @@ func (cfg *apiConfig) CreateUserHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if !validEmail(params.Email) {
+		respondWithError(w, 400, "Invalid email address")
+		return
+	}
+
+	if !validHandle(params.Handle) {
+		respondWithError(w, 400, "Handle must be 3 to 30 letters, digits or underscores")
+		return
+	}
+
 	hashedPassword, err := auth.HashPassword(params.Password)
 
 	if err != nil {
@@ -103,99 +260,167 @@ func (cfg *apiConfig) CreateUserHandler(w http.ResponseWriter, r *http.Request)
 	createUserParams := database.CreateUserParams{
 		Email:          params.Email,
 		HashedPassword: hashedPassword,
+		Handle:         params.Handle,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	user, err := cfg.DB.CreateUser(r.Context(), createUserParams)
 
+	if isHandleTaken(err) {
+		respondWithError(w, 409, "Handle is already taken")
+		return
+	}
+
 	if err != nil {
 		log.Printf("Error creating user: %s", err)
 		w.WriteHeader(500)
 		return
 	}
 
-	respBody := User{
-		ID:          user.ID,
-		CreatedAt:   user.CreatedAt,
-		UpdatedAt:   user.UpdatedAt,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed.Valid && user.IsChirpyRed.Bool,
+	// New accounts start unverified; the user can ask for another mail if this one fails
+	err = cfg.sendEmailVerification(r.Context(), user.ID, user.Email)
+
+	if err != nil {
+		log.Printf("Error sending verification mail: %s", err)
 	}
 
-	respondWithJSON(w, 201, respBody)
+	respondWithJSON(w, 201, toUser(user))
 }
 
 func (cfg *apiConfig) AddChirpHandler(w http.ResponseWriter, r *http.Request) {
 
 	type parameters struct {
-		Body   string    `json:"body"`
-		UserID uuid.UUID `json:"user_id"`
+		Body        string     `json:"body"`
+		UserID      uuid.UUID  `json:"user_id"`
+		InReplyToID *uuid.UUID `json:"in_reply_to_id"`
+		QuoteOfID   *uuid.UUID `json:"quote_of_id"`
 	}
 
-	token, tokenError := auth.GetBearerToken(r.Header)
+	caller, ok := requireScope(w, r, auth.ScopeChirpsWrite)
 
-	if tokenError != nil {
-		log.Printf("Error getting bearer token: %s", tokenError)
-		w.WriteHeader(401)
+	if !ok {
 		return
 	}
+	userIDFromJWT := caller.UserID
 
-	userIDFromJWT, err := auth.ValidateJWT(token, cfg.JWT_SECRET)
+	user, err := cfg.DB.GetUserById(r.Context(), userIDFromJWT)
 
 	if err != nil {
-		log.Printf("Error validating JWT: %s", err)
+		log.Printf("Error retrieving user from database: %s", err)
 		w.WriteHeader(401)
 		return
 	}
 
+	if !cfg.unverifiedPolicy.canPostChirps(user) {
+		respondWithError(w, 403, "Verify your email address before posting chirps")
+		return
+	}
+
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err = decoder.Decode(&params)
 	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+		respondWithError(w, 400, "Error decoding parameters")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	if len(params.Body) <= 140 {
-		params.Body = badWorldReplacement(params.Body)
-	} else {
-		respondWithError(w, 400, "Chirp is too long")
+	params.Body, err = validateChirpBody(params.Body, params.QuoteOfID != nil)
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
 		return
 	}
 
 	chirpParams := database.CreateChirpParams{
 		Body:   params.Body,
-		UserID: userIDFromJWT,
+		UserID: uuid.NullUUID{UUID: userIDFromJWT, Valid: true},
+	}
+
+	if params.InReplyToID != nil {
+		parent, err := cfg.getOriginalChirp(r.Context(), *params.InReplyToID)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, "Chirp to reply to not found")
+			return
+		}
+
+		if err != nil {
+			log.Printf("Error retrieving chirp from database: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		if parent.DeletedAt.Valid {
+			respondWithError(w, 400, "Can't reply to a deleted chirp")
+			return
+		}
+
+		chirpParams.InReplyToID = uuid.NullUUID{UUID: parent.ID, Valid: true}
+	}
+
+	if params.QuoteOfID != nil {
+		quoted, err := cfg.getOriginalChirp(r.Context(), *params.QuoteOfID)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, "Chirp to quote not found")
+			return
+		}
+
+		if err != nil {
+			log.Printf("Error retrieving chirp from database: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		if quoted.DeletedAt.Valid {
+			respondWithError(w, 400, "Can't quote a deleted chirp")
+			return
+		}
+
+		chirpParams.QuoteOfID = uuid.NullUUID{UUID: quoted.ID, Valid: true}
 	}
 
 	chirp, err := cfg.DB.CreateChirp(r.Context(), chirpParams)
 
+	// The chirp replied to or quoted was deleted in the meantime
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		if pqErr.Constraint == "chirps_quote_of_id_fkey" {
+			respondWithError(w, 404, "Chirp to quote not found")
+		} else {
+			respondWithError(w, 404, "Chirp to reply to not found")
+		}
+		return
+	}
+
 	if err != nil {
 		log.Printf("Error creating chirp: %s", err)
 		w.WriteHeader(500)
 		return
 	}
 
-	respBody := Chirp{
-		ID:        chirp.ID,
-		CreatedAt: chirp.CreatedAt,
-		UpdatedAt: chirp.UpdatedAt,
-		Body:      chirp.Body,
-		UserID:    userIDFromJWT,
+	respBody := []Chirp{toChirp(chirp)}
+	err = cfg.prepareChirps(r, respBody)
+
+	if err != nil {
+		log.Printf("Error preparing chirp: %s", err)
+		w.WriteHeader(500)
+		return
 	}
 
-	respondWithJSON(w, 201, respBody)
+	respondWithJSON(w, 201, respBody[0])
 }
 
+// GetChirpsHandler lists chirps a page at a time, oldest first unless
+// sort=desc. The next page is linked in the Link header. With author_id,
+// the author's rechirps are listed too, told apart by rechirp_of_id.
 func (cfg *apiConfig) GetChirpsHandler(w http.ResponseWriter, r *http.Request) {
-	chirps := []database.Chirp{}
 	s := r.URL.Query().Get("author_id")
 	sortOrder := r.URL.Query().Get("sort")
-	authorID := uuid.Nil
+	authorID := uuid.NullUUID{}
 	if s != "" {
 		res, err := uuid.Parse(s)
 
@@ -204,60 +429,84 @@ func (cfg *apiConfig) GetChirpsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		authorID = res
+		authorID = uuid.NullUUID{UUID: res, Valid: true}
 	}
 
-	if authorID == uuid.Nil {
-		res, err := cfg.DB.GetAllChirps(r.Context())
+	if sortOrder != "" && sortOrder != "asc" && sortOrder != "desc" {
+		respondWithError(w, 400, "sort must be asc or desc")
+		return
+	}
 
-		if err != nil {
-			log.Printf("Error retrieving chirps from database: %s", err)
-			w.WriteHeader(500)
-			return
-		}
-		chirps = res
-	} else {
-		res, err := cfg.DB.GetChirpsByUserId(r.Context(), authorID)
+	page, err := pagination.FromQuery(r.URL.Query())
 
-		if err != nil {
-			log.Printf("Error retrieving chirps from database: %s", err)
-			w.WriteHeader(500)
-			return
-		}
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	var chirps []database.ListChirpsRow
+	cursorCreatedAt, cursorID := cursorArgs(page.After)
 
-		chirps = res
+	if sortOrder == "desc" {
+		var rows []database.ListChirpsDescRow
+		rows, err = cfg.DB.ListChirpsDesc(r.Context(), database.ListChirpsDescParams{
+			AuthorID:        authorID,
+			BeforeCreatedAt: cursorCreatedAt,
+			BeforeID:        cursorID,
+			PageSize:        int32(page.Limit + 1),
+		})
 
+		for _, row := range rows {
+			chirps = append(chirps, database.ListChirpsRow(row))
+		}
+	} else {
+		chirps, err = cfg.DB.ListChirps(r.Context(), database.ListChirpsParams{
+			AuthorID:       authorID,
+			AfterCreatedAt: cursorCreatedAt,
+			AfterID:        cursorID,
+			PageSize:       int32(page.Limit + 1),
+		})
 	}
 
-	respBody := make([]Chirp, len(chirps))
+	if err != nil {
+		log.Printf("Error retrieving chirps from database: %s", err)
+		w.WriteHeader(500)
+		return
+	}
 
-	sort.Slice(chirps, func(i, j int) bool {
-		if sortOrder == "desc" {
-			return chirps[i].CreatedAt.After(chirps[j].CreatedAt)
-		}
+	chirps, next := pagination.Cut(chirps, page, chirpCursor)
 
-		return chirps[i].CreatedAt.Before(chirps[j].CreatedAt)
-	})
+	respBody := make([]Chirp, len(chirps))
 
 	for i, chirp := range chirps {
-		respBody[i] = Chirp{
-			ID:        chirp.ID,
-			CreatedAt: chirp.CreatedAt,
-			UpdatedAt: chirp.UpdatedAt,
-			Body:      chirp.Body,
-			UserID:    chirp.UserID,
-		}
+		respBody[i] = toChirp(chirp)
 	}
 
-	dat, err := json.Marshal(respBody)
+	err = cfg.prepareChirps(r, respBody)
 
 	if err != nil {
-		log.Printf("Error marshalling JSON")
+		log.Printf("Error preparing chirps: %s", err)
 		w.WriteHeader(500)
 		return
 	}
-	w.WriteHeader(200)
-	w.Write(dat)
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
+
+// cursorArgs turns a page cursor into the nullable query arguments that
+// mean "from the start" when the cursor is nil.
+func cursorArgs(cursor *pagination.Cursor) (sql.NullTime, uuid.NullUUID) {
+	if cursor == nil {
+		return sql.NullTime{}, uuid.NullUUID{}
+	}
+
+	return sql.NullTime{Time: cursor.CreatedAt, Valid: true}, uuid.NullUUID{UUID: cursor.ID, Valid: true}
+}
+
+func chirpCursor[T chirpRow](row T) pagination.Cursor {
+	chirp := database.GetChirpRow(row)
+	return pagination.Cursor{CreatedAt: chirp.CreatedAt, ID: chirp.ID}
 }
 
 func (cfg *apiConfig) GetChirpHandler(w http.ResponseWriter, r *http.Request) {
@@ -279,21 +528,24 @@ func (cfg *apiConfig) GetChirpHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respBody := Chirp{
-		ID:        chirp.ID,
-		CreatedAt: chirp.CreatedAt,
-		UpdatedAt: chirp.UpdatedAt,
-		Body:      chirp.Body,
-		UserID:    chirp.UserID,
+	respBody := []Chirp{toChirp(chirp)}
+
+	err = cfg.prepareChirps(r, respBody)
+
+	if err != nil {
+		log.Printf("Error preparing chirp: %s", err)
+		w.WriteHeader(500)
+		return
 	}
 
-	respondWithJSON(w, 200, respBody)
+	respondWithJSON(w, 200, respBody[0])
 }
 
 func (cfg *apiConfig) LoginUserHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		UseCookies bool   `json:"use_cookies"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -305,28 +557,110 @@ func (cfg *apiConfig) LoginUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Determine JWT expiration time
-	const jwtExpirationTime = 3600
-
 	w.Header().Set("Content-Type", "application/json")
 
+	ip := cfg.clientIP(r)
+
+	lock, err := cfg.loginLockedFor(r.Context(), accountThrottleKey(params.Email), ipThrottleKey(ip))
+
+	if err != nil {
+		log.Printf("Error checking login throttle: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if lock > 0 {
+		respondLoginLocked(w, lock)
+		return
+	}
+
 	user, err := cfg.DB.GetUserByEmail(r.Context(), params.Email)
 
+	if errors.Is(err, sql.ErrNoRows) {
+		// Spend the same time as for a wrong password and answer the same way,
+		// so the response doesn't tell whether the account exists
+		auth.CheckPasswordHash(dummyPasswordHash(), params.Password)
+		cfg.recordFailedLogin(r.Context(), params.Email, ip)
+		respondWithError(w, 401, "Incorrect email or password")
+		return
+	}
+
 	if err != nil {
 		log.Printf("Error retrieving user from database: %s", err)
-		w.WriteHeader(404)
+		w.WriteHeader(500)
 		return
 	}
 
 	err = auth.CheckPasswordHash(user.HashedPassword, params.Password)
 
 	if err != nil {
-		log.Printf("Incorrect email or password")
-		w.WriteHeader(401)
+		cfg.recordFailedLogin(r.Context(), params.Email, ip)
+		respondWithError(w, 401, "Incorrect email or password")
+		return
+	}
+
+	// Upgrade hashes made with an older algorithm or weaker parameters while
+	// we have the password. A failure here must not prevent the login.
+	if auth.PasswordNeedsRehash(user.HashedPassword) {
+		cfg.rehashPassword(r.Context(), user, params.Password)
+	}
+
+	if user.DeletedAt.Valid {
+		respondWithError(w, 403, accountDeletedMessage)
 		return
 	}
 
-	jwt, err := auth.MakeJWT(user.ID, cfg.JWT_SECRET, time.Duration(jwtExpirationTime)*time.Second)
+	if !cfg.unverifiedPolicy.canLogIn(user) {
+		respondWithError(w, 403, "Verify your email address before logging in")
+		return
+	}
+
+	// Only a full login clears the account counter, with two-factor
+	// authentication that happens in mfaLoginHandler
+	if !user.TotpEnabledAt.Valid {
+		cfg.clearLoginFailures(r.Context(), user.Email)
+	}
+
+	// With two-factor authentication the password is only the first step,
+	// the real tokens are handed out by mfaLoginHandler
+	if user.TotpEnabledAt.Valid {
+		cfg.respondWithMFAChallenge(w, user)
+		return
+	}
+
+	cfg.respondWithSession(w, r, user, params.UseCookies)
+}
+
+// rehashPassword replaces the user's password hash with one from the current hasher.
+// The update only applies if the hash hasn't changed since we read it,
+// so a concurrent password change is never overwritten.
+func (cfg *apiConfig) rehashPassword(ctx context.Context, user database.User, password string) {
+	newHash, err := auth.HashPassword(password)
+
+	if err != nil {
+		log.Printf("Error rehashing password: %s", err)
+		return
+	}
+
+	err = cfg.DB.RehashUserPassword(ctx, database.RehashUserPasswordParams{
+		NewHash: newHash,
+		ID:      user.ID,
+		OldHash: user.HashedPassword,
+	})
+
+	if err != nil {
+		log.Printf("Error storing rehashed password: %s", err)
+	}
+}
+
+// Lifetime of the JWTs handed out at login and refresh
+const accessTokenExpiration = time.Hour
+
+// respondWithSession logs the user in: it creates a JWT and a refresh token
+// starting a new family, and writes them with the user's profile.
+// With useCookies the tokens are set as cookies instead of returned in the body.
+func (cfg *apiConfig) respondWithSession(w http.ResponseWriter, r *http.Request, user database.User, useCookies bool) {
+	jwt, err := auth.MakeJWT(user.ID, cfg.jwtKeys, accessTokenExpiration)
 
 	if err != nil {
 		log.Printf("Error creating JWT: %s", err)
@@ -342,12 +676,16 @@ func (cfg *apiConfig) LoginUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Every login starts a new refresh token family
 	refreshTokenParams := database.CreateRefreshTokenParams{
-		Token:  refreshToken,
-		UserID: user.ID,
+		TokenHash: auth.HashToken(refreshToken),
+		UserID:    user.ID,
+		FamilyID:  uuid.New(),
+		UserAgent: sessionUserAgent(r),
+		IpAddress: cfg.clientIP(r),
 	}
 
-	_, err = cfg.DB.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams(refreshTokenParams))
+	storedRefreshToken, err := cfg.DB.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams(refreshTokenParams))
 
 	if err != nil {
 		log.Printf("Error storing refresh token: %s", err)
@@ -356,72 +694,194 @@ func (cfg *apiConfig) LoginUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respBody := struct {
-		ID           uuid.UUID `json:"id"`
-		CreatedAt    time.Time `json:"created_at"`
-		UpdatedAt    time.Time `json:"updated_at"`
-		Email        string    `json:"email"`
-		Token        string    `json:"token"`
-		RefreshToken string    `json:"refresh_token"`
-		IsChirpyRed  bool      `json:"is_chirpy_red"`
+		ID              uuid.UUID `json:"id"`
+		CreatedAt       time.Time `json:"created_at"`
+		UpdatedAt       time.Time `json:"updated_at"`
+		Email           string    `json:"email"`
+		Handle          string    `json:"handle"`
+		Token           string    `json:"token,omitempty"`
+		RefreshToken    string    `json:"refresh_token,omitempty"`
+		CSRFToken       string    `json:"csrf_token,omitempty"`
+		IsChirpyRed     bool      `json:"is_chirpy_red"`
+		IsEmailVerified bool      `json:"is_email_verified"`
+		Role            string    `json:"role"`
 	}{
-		ID:           user.ID,
-		CreatedAt:    user.CreatedAt,
-		UpdatedAt:    user.UpdatedAt,
-		Email:        user.Email,
-		Token:        jwt,
-		RefreshToken: refreshToken,
-		IsChirpyRed:  user.IsChirpyRed.Valid && user.IsChirpyRed.Bool,
+		ID:              user.ID,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+		Email:           user.Email,
+		Handle:          user.Handle,
+		Token:           jwt,
+		RefreshToken:    refreshToken,
+		IsChirpyRed:     user.IsChirpyRed.Valid && user.IsChirpyRed.Bool,
+		IsEmailVerified: user.EmailVerifiedAt.Valid,
+		Role:            user.Role,
+	}
+
+	if useCookies {
+		csrfToken, err := auth.MakeCSRFToken()
+
+		if err != nil {
+			log.Printf("Error creating CSRF token: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		setSessionCookies(w, jwt, refreshToken, storedRefreshToken.ExpiresAt, csrfToken)
+
+		respBody.Token = ""
+		respBody.RefreshToken = ""
+		respBody.CSRFToken = csrfToken
 	}
 
 	respondWithJSON(w, 200, respBody)
 
 }
 
-func (cfg *apiConfig) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+var (
+	errRefreshTokenNotFound = errors.New("refresh token cannot be found")
+	errRefreshTokenRevoked  = errors.New("refresh token has been revoked")
+	errRefreshTokenExpired  = errors.New("refresh token expired")
+)
+
+// rotateRefreshToken revokes the presented refresh token and replaces it with a
+// child in the same family, returning the stored child and the new token.
+// If a token that was already revoked is presented again, we assume it was stolen
+// and revoke the whole family, forcing the user to log in again.
+// clientID is the app the token must have been issued to, or uuid.NullUUID{}
+// for refresh tokens from a login.
+func (cfg *apiConfig) rotateRefreshToken(r *http.Request, token string, clientID uuid.NullUUID) (database.RefreshToken, string, error) {
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
 
 	if err != nil {
-		log.Printf("Error getting token from the header: %s", err)
-		w.WriteHeader(500)
-		return
+		return database.RefreshToken{}, "", err
 	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
 
-	refreshToken, err := cfg.DB.GetRefreshToken(r.Context(), token)
+	refreshToken, err := qtx.GetRefreshTokenForUpdate(r.Context(), auth.HashToken(token))
+
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && refreshToken.ClientID != clientID) {
+		return database.RefreshToken{}, "", errRefreshTokenNotFound
+	}
 
 	if err != nil {
-		respondWithError(w, 401, "Refresh token cannot be found in the database")
-		return
+		return database.RefreshToken{}, "", err
+	}
+
+	if refreshToken.RevokedAt.Valid {
+		// If RevokedAt has a valid (non-NULL) timestamp, the token is revoked.
+		// Presenting it again means it has been reused, so the whole family goes.
+		err = qtx.RevokeRefreshTokenFamily(r.Context(), refreshToken.FamilyID)
+
+		if err != nil {
+			return database.RefreshToken{}, "", err
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return database.RefreshToken{}, "", err
+		}
+
+		log.Printf("Refresh token reuse detected for user %s", refreshToken.UserID)
+		return database.RefreshToken{}, "", errRefreshTokenRevoked
 	}
 
 	if time.Now().After(refreshToken.ExpiresAt) {
-		respondWithError(w, 401, "Refresh token expired")
+		return database.RefreshToken{}, "", errRefreshTokenExpired
+	}
+
+	err = qtx.RevokeRefreshToken(r.Context(), refreshToken.TokenHash)
+
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+
+	newRefreshToken, err := auth.MakeRefreshToken()
+
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+
+	storedRefreshToken, err := qtx.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
+		TokenHash:       auth.HashToken(newRefreshToken),
+		UserID:          refreshToken.UserID,
+		FamilyID:        refreshToken.FamilyID,
+		ParentTokenHash: sql.NullString{String: refreshToken.TokenHash, Valid: true},
+		UserAgent:       sessionUserAgent(r),
+		IpAddress:       cfg.clientIP(r),
+		ClientID:        refreshToken.ClientID,
+		Scopes:          refreshToken.Scopes,
+	})
+
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+
+	return storedRefreshToken, newRefreshToken, tx.Commit()
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new JWT and a new refresh token.
+func (cfg *apiConfig) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, fromCookie, err := requestToken(r, refreshTokenCookie)
+
+	if errors.Is(err, errInvalidCSRFToken) {
+		respondWithError(w, 403, "Missing or invalid CSRF token")
 		return
 	}
 
-	if refreshToken.RevokedAt.Valid {
-		// If RevokedAt has a valid (non-NULL) timestamp, the token is revoked
+	if err != nil {
+		log.Printf("Error getting refresh token from the request: %s", err)
+		respondUnauthorized(w, errNoCredentials)
+		return
+	}
+
+	storedRefreshToken, newRefreshToken, err := cfg.rotateRefreshToken(r, token, uuid.NullUUID{})
+
+	if errors.Is(err, errRefreshTokenNotFound) {
+		respondWithError(w, 401, "Refresh token cannot be found in the database")
+		return
+	}
+
+	if errors.Is(err, errRefreshTokenRevoked) {
 		respondWithError(w, 401, "Refresh token has been revoked")
 		return
 	}
 
-	user, err := cfg.DB.GetUserFromRefreshToken(r.Context(), refreshToken.UserID)
+	if errors.Is(err, errRefreshTokenExpired) {
+		respondWithError(w, 401, "Refresh token expired")
+		return
+	}
 
 	if err != nil {
-		respondWithError(w, 404, "Cannot find user based on the refresh token")
+		log.Printf("Error rotating refresh token: %s", err)
+		respondWithError(w, 500, "Error rotating refresh token")
 		return
 	}
 
-	jwt, err := auth.MakeJWT(user.ID, cfg.JWT_SECRET, time.Duration(3600)*time.Second)
+	jwt, err := auth.MakeJWT(storedRefreshToken.UserID, cfg.jwtKeys, accessTokenExpiration)
 
 	if err != nil {
 		respondWithError(w, 500, "Error creating new JWT")
 		return
 	}
 
+	// The CSRF token lives as long as the session, so it's passed on as is
+	if fromCookie {
+		csrfCookie, _ := r.Cookie(csrfTokenCookie)
+		setSessionCookies(w, jwt, newRefreshToken, storedRefreshToken.ExpiresAt, csrfCookie.Value)
+		w.WriteHeader(204)
+		return
+	}
+
 	respBody := struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}{
-		Token: jwt,
+		Token:        jwt,
+		RefreshToken: newRefreshToken,
 	}
 
 	respondWithJSON(w, 200, respBody)
@@ -429,15 +889,33 @@ func (cfg *apiConfig) RefreshTokenHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (cfg *apiConfig) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+	token, fromCookie, err := requestToken(r, refreshTokenCookie)
+
+	if errors.Is(err, errInvalidCSRFToken) {
+		respondWithError(w, 403, "Missing or invalid CSRF token")
+		return
+	}
 
 	if err != nil {
-		log.Printf("Error getting token from the header: %s", err)
-		w.WriteHeader(500)
+		log.Printf("Error getting refresh token from the request: %s", err)
+		respondUnauthorized(w, errNoCredentials)
+		return
+	}
+
+	// The browser forgets the session even if the token turns out to be unknown
+	if fromCookie {
+		clearSessionCookies(w)
+	}
+
+	refreshToken, err := cfg.DB.GetRefreshToken(r.Context(), auth.HashToken(token))
+
+	if err != nil {
+		respondWithError(w, 401, "Refresh token cannot be found in the database")
 		return
 	}
 
-	err = cfg.DB.RevokeRefreshToken(r.Context(), token)
+	// Logging out ends the whole session, not just the latest token in it
+	err = cfg.DB.RevokeRefreshTokenFamily(r.Context(), refreshToken.FamilyID)
 
 	if err != nil {
 		respondWithError(w, 500, "Cannot update refresh token in database")
@@ -447,72 +925,214 @@ func (cfg *apiConfig) RevokeTokenHandler(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(204)
 }
 
+// updateUserHandler changes only the fields present in the request. A new
+// password or email needs the current password, a new email is staged until
+// it is verified.
 func (cfg *apiConfig) updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		profileUpdate
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, 500, "Error decoding parameters")
+		respondWithError(w, 400, "Error decoding parameters")
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	caller, ok := requireScope(w, r, auth.ScopeProfileWrite)
 
-	if err != nil {
-		respondWithError(w, 401, "Error getting token from the header")
+	if !ok {
 		return
 	}
-	userIDFromJWT, err := auth.ValidateJWT(token, cfg.JWT_SECRET)
+	userIDFromJWT := caller.UserID
 
-	if err != nil {
-		respondWithError(w, 401, "Error validating JWT")
+	if params.Email != nil && !validEmail(*params.Email) {
+		respondWithError(w, 400, "Invalid email address")
 		return
 	}
 
-	hashedPassword, err := auth.HashPassword(params.Password)
+	if params.Password != nil && *params.Password == "" {
+		respondWithError(w, 400, "Password can't be empty")
+		return
+	}
+
+	if msg := params.profileUpdate.validate(); msg != "" {
+		respondWithError(w, 400, msg)
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), userIDFromJWT)
 
 	if err != nil {
-		respondWithError(w, 500, "Error hashing password")
+		respondWithError(w, 404, "User not found in database")
 		return
 	}
 
-	updateUserParams := database.UpdateUserByIdParams{
-		ID:             userIDFromJWT,
-		Email:          params.Email,
-		HashedPassword: hashedPassword,
+	emailChanged := params.Email != nil && *params.Email != user.Email
+
+	// Check the current password before changing anything. A new email needs
+	// it too: once verified, it could take the account over through a reset
+	if params.Password != nil || emailChanged {
+		ok = cfg.checkCurrentPassword(w, r, user, params.CurrentPassword)
+
+		if !ok {
+			return
+		}
 	}
 
-	err = cfg.DB.UpdateUserById(r.Context(), updateUserParams)
+	// Hashing is slow, it's done before the transaction
+	hashedPassword := user.HashedPassword
+
+	if params.Password != nil {
+		hashedPassword, err = auth.HashPassword(*params.Password)
+
+		if err != nil {
+			respondWithError(w, 500, "Error hashing password")
+			return
+		}
+	}
+
+	// All changes are applied together, or none if one fails
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
 
 	if err != nil {
 		respondWithError(w, 500, "Error updating user in database")
 		return
 	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	if !params.profileUpdate.isEmpty() {
+		_, err = qtx.UpdateUserProfile(r.Context(), params.profileUpdate.apply(user))
+
+		if isHandleTaken(err) {
+			respondWithError(w, 409, "Handle is already taken")
+			return
+		}
+
+		if err != nil {
+			respondWithError(w, 500, "Error updating user in database")
+			return
+		}
+	}
+
+	if params.Password != nil {
+		// The login email only changes once the new address is verified,
+		// until then it is staged as pending_email
+		updateUserParams := database.UpdateUserByIdParams{
+			ID:             userIDFromJWT,
+			Email:          user.Email,
+			HashedPassword: hashedPassword,
+		}
+
+		err = qtx.UpdateUserById(r.Context(), updateUserParams)
+
+		if err != nil {
+			respondWithError(w, 500, "Error updating user in database")
+			return
+		}
+	}
+
+	if emailChanged {
+		err = qtx.SetUserPendingEmail(r.Context(), database.SetUserPendingEmailParams{
+			ID:           userIDFromJWT,
+			PendingEmail: sql.NullString{String: *params.Email, Valid: true},
+		})
+
+		if err != nil {
+			respondWithError(w, 500, "Error updating user in database")
+			return
+		}
+	} else if params.Email != nil && user.PendingEmail.Valid {
+		// Going back to the current email cancels the pending change
+		err = qtx.SetUserPendingEmail(r.Context(), database.SetUserPendingEmailParams{
+			ID: userIDFromJWT,
+		})
+
+		if err != nil {
+			respondWithError(w, 500, "Error updating user in database")
+			return
+		}
+	}
 
-	updatedUser, err := cfg.DB.GetUserByEmail(r.Context(), params.Email)
+	updatedUser, err := qtx.GetUserById(r.Context(), userIDFromJWT)
 	if err != nil {
 		respondWithError(w, 500, "Error getting updated user")
 		return
 	}
 
-	type userResponse struct {
-		ID    string `json:"id"`
-		Email string `json:"email"`
+	err = tx.Commit()
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating user in database")
+		return
+	}
+
+	// Mailed once the change is saved; the user can ask for another mail if this one fails
+	if emailChanged {
+		err = cfg.sendEmailVerification(r.Context(), userIDFromJWT, *params.Email)
+
+		if err != nil {
+			log.Printf("Error sending verification mail: %s", err)
+			respondWithError(w, 500, "Error sending verification mail")
+			return
+		}
 	}
 
-	// After getting the updated user
-	response := userResponse{
-		ID:    updatedUser.ID.String(),
-		Email: updatedUser.Email,
+	respBody := struct {
+		User
+		PendingEmail string `json:"pending_email,omitempty"`
+	}{
+		User:         toUser(updatedUser),
+		PendingEmail: updatedUser.PendingEmail.String,
 	}
-	respondWithJSON(w, 200, response)
 
-	w.WriteHeader(200)
+	respondWithJSON(w, 200, respBody)
+}
+
+// checkCurrentPassword re-authenticates the user before a sensitive change.
+// The check counts towards the login throttle like any other password guess.
+func (cfg *apiConfig) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user database.User, password string) bool {
+	ip := cfg.clientIP(r)
+
+	lock, err := cfg.loginLockedFor(r.Context(), accountThrottleKey(user.Email), ipThrottleKey(ip))
+
+	if err != nil {
+		respondWithError(w, 500, "Error checking login throttle")
+		return false
+	}
+
+	if lock > 0 {
+		respondLoginLocked(w, lock)
+		return false
+	}
+
+	// Accounts made through an identity provider have no password to confirm
+	if user.HashedPassword == auth.UnusablePasswordHash {
+		respondWithError(w, 403, "Set a password with a password reset first")
+		return false
+	}
+
+	if password == "" {
+		respondWithError(w, 400, "Current password is required")
+		return false
+	}
+
+	err = auth.CheckPasswordHash(user.HashedPassword, password)
+
+	if err != nil {
+		cfg.recordFailedLogin(r.Context(), user.Email, ip)
+		respondWithError(w, 401, "Incorrect password")
+		return false
+	}
+
+	return true
 }
 
 func (cfg *apiConfig) deleteChirpByIdHandler(w http.ResponseWriter, r *http.Request) {
@@ -524,18 +1144,12 @@ func (cfg *apiConfig) deleteChirpByIdHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-
-	if err != nil {
-		respondWithError(w, 401, "Error getting token from the header")
-		return
-	}
-	userId, err := auth.ValidateJWT(token, cfg.JWT_SECRET)
+	caller, ok := requireScope(w, r, auth.ScopeChirpsDelete)
 
-	if err != nil {
-		respondWithError(w, 401, "Error validating JWT")
+	if !ok {
 		return
 	}
+	userId := caller.UserID
 
 	chirp, err := cfg.DB.GetChirp(r.Context(), chirpID)
 
@@ -544,18 +1158,59 @@ func (cfg *apiConfig) deleteChirpByIdHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if chirp.UserID != userId {
+	if !chirp.UserID.Valid || chirp.UserID.UUID != userId {
 		respondWithError(w, 403, "You are not authorized to delete this chirp")
 		return
 	}
 
-	err = cfg.DB.DeleteChirpById(r.Context(), chirpID)
+	if chirp.DeletedAt.Valid {
+		respondWithError(w, 404, "Chirp not found in database")
+		return
+	}
+
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
+
+	if err != nil {
+		respondWithError(w, 500, "Error deleting chirp")
+		return
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	n, err := qtx.DeleteChirpById(r.Context(), chirpID)
 
 	if err != nil {
 		respondWithError(w, 404, "Chirp not found in database")
 		return
 	}
 
+	if n == 0 {
+		// A chirp with replies or quotes stays as a tombstone, so they hold together
+		n, err = qtx.TombstoneChirp(r.Context(), chirpID)
+
+		if err != nil || n == 0 {
+			respondWithError(w, 404, "Chirp not found in database")
+			return
+		}
+	} else {
+		// Tombstones only kept for this chirp can go now
+		err = pruneTombstones(r.Context(), qtx, appendChirpRefs(nil, chirp.InReplyToID, chirp.QuoteOfID))
+
+		if err != nil {
+			log.Printf("Error deleting unreferenced tombstones: %s", err)
+			respondWithError(w, 500, "Error deleting chirp")
+			return
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		respondWithError(w, 500, "Error deleting chirp")
+		return
+	}
+
 	w.WriteHeader(204)
 }
 
@@ -602,3 +1257,12 @@ func (cfg *apiConfig) polkaWebhookHandler(w http.ResponseWriter, r *http.Request
 	}
 
 }
+
+// jwksHandler publishes the public keys used to sign JWTs so other services
+// can verify Chirpy tokens without holding any secret.
+func (cfg *apiConfig) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	respondWithJSON(w, 200, cfg.jwtKeys.JWKS())
+}
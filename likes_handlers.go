@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+func (cfg *apiConfig) likeChirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirpID")
+		return
+	}
+
+	caller, ok := requireScope(w, r, auth.ScopeLikesWrite)
+
+	if !ok {
+		return
+	}
+
+	chirp, err := cfg.getOriginalChirp(r.Context(), chirpID)
+
+	if errors.Is(err, sql.ErrNoRows) || err == nil && chirp.DeletedAt.Valid {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving chirp from database: %s", err)
+		respondWithError(w, 500, "Error liking chirp")
+		return
+	}
+
+	// Liking a rechirp likes the original. Liking twice is not an error and
+	// doesn't count twice; like_count is kept up to date by a trigger.
+	err = cfg.DB.LikeChirp(r.Context(), database.LikeChirpParams{
+		UserID:  caller.UserID,
+		ChirpID: chirp.ID,
+	})
+
+	// The chirp was deleted in the meantime
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error liking chirp: %s", err)
+		respondWithError(w, 500, "Error liking chirp")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) unlikeChirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirpID")
+		return
+	}
+
+	caller, ok := requireScope(w, r, auth.ScopeLikesWrite)
+
+	if !ok {
+		return
+	}
+
+	chirp, err := cfg.getOriginalChirp(r.Context(), chirpID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving chirp from database: %s", err)
+		respondWithError(w, 500, "Error unliking chirp")
+		return
+	}
+
+	// Tombstones can still be unliked, so no like is stuck
+	err = cfg.DB.UnlikeChirp(r.Context(), database.UnlikeChirpParams{
+		UserID:  caller.UserID,
+		ChirpID: chirp.ID,
+	})
+
+	if err != nil {
+		log.Printf("Error unliking chirp: %s", err)
+		respondWithError(w, 500, "Error unliking chirp")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// markLikedChirps sets LikedByMe on the chirps the caller has liked, with one
+// query for all of them. Anonymous requests leave every flag false.
+func (cfg *apiConfig) markLikedChirps(ctx context.Context, chirps []Chirp) error {
+	caller, ok := principalFrom(ctx)
+
+	if !ok || len(chirps) == 0 {
+		return nil
+	}
+
+	chirpIDs := make([]uuid.UUID, len(chirps))
+
+	for i, chirp := range chirps {
+		chirpIDs[i] = chirp.ID
+	}
+
+	liked, err := cfg.DB.ListLikedChirpIds(ctx, database.ListLikedChirpIdsParams{
+		UserID:   caller.UserID,
+		ChirpIds: chirpIDs,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	likedSet := make(map[uuid.UUID]bool, len(liked))
+
+	for _, id := range liked {
+		likedSet[id] = true
+	}
+
+	for i, chirp := range chirps {
+		chirps[i].LikedByMe = likedSet[chirp.ID]
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// Failed logins allowed before an account or IP address gets locked.
+// Past that, every further failure doubles the lock, up to maxLoginLock.
+const (
+	freeAccountLoginAttempts = 5
+	freeIPLoginAttempts      = 20
+	firstLoginLock           = time.Minute
+	maxLoginLock             = time.Hour
+)
+
+// Accounts are keyed by the email that was tried, whether or not it belongs
+// to a user, so a lockout doesn't tell an attacker the account exists.
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP returns the address of the caller. X-Forwarded-For is only
+// trusted when the server runs behind a proxy that sets it (TRUST_PROXY=true).
+func (cfg *apiConfig) clientIP(r *http.Request) string {
+	if cfg.trustProxy {
+		forwarded := r.Header.Get("X-Forwarded-For")
+		if forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// loginLockedFor returns how long the longest lock on any of the keys lasts.
+func (cfg *apiConfig) loginLockedFor(ctx context.Context, keys ...string) (time.Duration, error) {
+	seconds, err := cfg.DB.GetLoginLockSeconds(ctx, keys)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// loginLockDuration is the lock for the given number of failures in a row.
+func loginLockDuration(failedAttempts, freeAttempts int32) time.Duration {
+	if failedAttempts <= freeAttempts {
+		return 0
+	}
+
+	lock := firstLoginLock
+	for i := freeAttempts + 1; i < failedAttempts && lock < maxLoginLock; i++ {
+		lock *= 2
+	}
+
+	return min(lock, maxLoginLock)
+}
+
+// recordFailedLogin counts a failure for the account and the IP address and
+// locks whichever went over its allowance.
+func (cfg *apiConfig) recordFailedLogin(ctx context.Context, email, ip string) {
+	limits := map[string]int32{
+		accountThrottleKey(email): freeAccountLoginAttempts,
+		ipThrottleKey(ip):         freeIPLoginAttempts,
+	}
+
+	for key, freeAttempts := range limits {
+		throttle, err := cfg.DB.RecordFailedLogin(ctx, key)
+
+		if err != nil {
+			log.Printf("Error recording failed login: %s", err)
+			continue
+		}
+
+		lock := loginLockDuration(throttle.FailedAttempts, freeAttempts)
+		if lock == 0 {
+			continue
+		}
+
+		err = cfg.DB.LockLogin(ctx, database.LockLoginParams{
+			LockSeconds: int32(lock / time.Second),
+			Key:         key,
+		})
+
+		if err != nil {
+			log.Printf("Error locking login: %s", err)
+		}
+	}
+}
+
+// clearLoginFailures resets the account counter after a successful login.
+// The IP counter is left alone, one good password shouldn't hide a spray
+// of guesses against other accounts from the same address.
+func (cfg *apiConfig) clearLoginFailures(ctx context.Context, email string) {
+	err := cfg.DB.ClearLoginThrottle(ctx, accountThrottleKey(email))
+
+	if err != nil {
+		log.Printf("Error clearing login throttle: %s", err)
+	}
+}
+
+// respondLoginLocked answers a locked out login with 429 and Retry-After.
+func respondLoginLocked(w http.ResponseWriter, lock time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(lock.Seconds())))
+	respondWithError(w, 429, "Too many failed login attempts, try again later")
+}
+
+// dummyPasswordHash is checked against when the email doesn't exist, so that
+// a login for an unknown account takes as long as one with a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := auth.HashPassword("chirpy-dummy-password")
+
+	if err != nil {
+		log.Printf("Error hashing dummy password: %s", err)
+	}
+
+	return hash
+})
+
+// unlockUserHandler lifts the lock on an account, e.g. after the owner
+// confirmed to support that the failed logins were their own.
+func (cfg *apiConfig) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid userID")
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), userID)
+
+	if err != nil {
+		respondWithError(w, 404, "User not found in database")
+		return
+	}
+
+	err = cfg.DB.ClearLoginThrottle(r.Context(), accountThrottleKey(user.Email))
+
+	if err != nil {
+		respondWithError(w, 500, "Error unlocking user")
+		return
+	}
+
+	w.WriteHeader(204)
+}
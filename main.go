@@ -1,23 +1,38 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
 	"sync/atomic"
+	"time"
 
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
 	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/mailer"
+	"github.com/ValentinoFilipetto/chirpy/internal/oidc"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
-	fileserverHits atomic.Int32
-	DB             *database.Queries
-	env            string
-	JWT_SECRET     string
-	POLKA_KEY      string
+	fileserverHits   atomic.Int32
+	DB               *database.Queries
+	dbConn           *sql.DB
+	env              string
+	jwtKeys          *auth.KeyRing
+	mailer           mailer.Mailer
+	unverifiedPolicy unverifiedUserPolicy
+	trustProxy       bool
+	oidcProviders    map[string]*oidc.Provider
+	// How long deleted accounts can be restored, and what then happens to their chirps
+	accountDeletionGrace time.Duration
+	deletedChirpsPolicy  deletedChirpsPolicy
+	// How long after posting authors can edit their chirps
+	editWindows editWindows
+	POLKA_KEY   string
 }
 
 func main() {
@@ -33,31 +48,161 @@ func main() {
 
 	dbQueries := database.New(db)
 
+	// `chirpy promote-admin <email>` makes the first admin, who can then
+	// manage the roles of everybody else through /admin/users/{userID}/role
+	if len(os.Args) > 1 && os.Args[1] == "promote-admin" {
+		err = promoteAdmin(dbQueries, os.Args[2:])
+
+		if err != nil {
+			fmt.Println("Error promoting admin:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// JWT signing keys
+	jwtKeys, err := loadJWTKeys()
+
+	if err != nil {
+		fmt.Println("Error loading JWT signing keys:", err)
+		return
+	}
+
+	unverifiedPolicy, err := parseUnverifiedUserPolicy(os.Getenv("UNVERIFIED_USER_POLICY"))
+
+	if err != nil {
+		fmt.Println("Error reading configuration:", err)
+		return
+	}
+
+	deletedChirpsPolicy, err := parseDeletedChirpsPolicy(os.Getenv("DELETED_USER_CHIRPS"))
+
+	if err != nil {
+		fmt.Println("Error reading configuration:", err)
+		return
+	}
+
+	accountDeletionGrace, err := parseAccountDeletionGrace(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"))
+
+	if err != nil {
+		fmt.Println("Error reading configuration:", err)
+		return
+	}
+
+	editWindow, err := parseEditWindow(os.Getenv("CHIRP_EDIT_WINDOW_MINUTES"), defaultEditWindow)
+
+	if err != nil {
+		fmt.Println("Error reading configuration:", err)
+		return
+	}
+
+	redEditWindow, err := parseEditWindow(os.Getenv("CHIRP_EDIT_WINDOW_RED_MINUTES"), defaultRedEditWindow)
+
+	if err != nil {
+		fmt.Println("Error reading configuration:", err)
+		return
+	}
+
+	oidcProviders, err := loadOIDCProviders()
+
+	if err != nil {
+		fmt.Println("Error loading identity providers:", err)
+		return
+	}
+
 	// Server configuration
 	mux := http.NewServeMux()
 	apiCfg := apiConfig{
-		DB:         dbQueries,
-		env:        os.Getenv("PLATFORM"),
-		JWT_SECRET: os.Getenv("JWT_SECRET"),
-		POLKA_KEY:  os.Getenv("POLKA_KEY"),
+		DB:                   dbQueries,
+		dbConn:               db,
+		env:                  os.Getenv("PLATFORM"),
+		jwtKeys:              jwtKeys,
+		mailer:               newMailer(),
+		unverifiedPolicy:     unverifiedPolicy,
+		trustProxy:           os.Getenv("TRUST_PROXY") == "true",
+		oidcProviders:        oidcProviders,
+		accountDeletionGrace: accountDeletionGrace,
+		deletedChirpsPolicy:  deletedChirpsPolicy,
+		editWindows:          editWindows{regular: editWindow, red: redEditWindow},
+		POLKA_KEY:            os.Getenv("POLKA_KEY"),
 	}
 
+	// Accounts past their grace period are purged in the background
+	go apiCfg.runAccountPurger(context.Background(), time.Hour)
+
 	fileServer := http.FileServer(http.Dir("."))
 	mux.Handle("/app/", apiCfg.middlewareMetrics(http.StripPrefix("/app", fileServer)))
 	mux.HandleFunc("GET /api/healthz", readinessHandler)
-	mux.HandleFunc("GET /api/chirps", apiCfg.GetChirpsHandler)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.GetChirpHandler)
-	mux.HandleFunc("POST /api/chirps", apiCfg.AddChirpHandler)
-	mux.HandleFunc("POST /api/users", apiCfg.CreateUserHandler)
-	mux.HandleFunc("POST /api/login", apiCfg.LoginUserHandler)
+	mux.HandleFunc("GET /.well-known/jwks.json", apiCfg.jwksHandler)
+
+	// Every API route declares whether it needs an authenticated caller
+	mux.Handle("GET /api/chirps", apiCfg.middlewareAuth(authOptional, apiCfg.GetChirpsHandler))
+	mux.Handle("GET /api/chirps/{chirpID}", apiCfg.middlewareAuth(authOptional, apiCfg.GetChirpHandler))
+	mux.Handle("GET /api/chirps/{chirpID}/thread", apiCfg.middlewareAuth(authOptional, apiCfg.getThreadHandler))
+	mux.Handle("GET /api/chirps/{chirpID}/revisions", apiCfg.middlewareAuth(authOptional, apiCfg.listChirpRevisionsHandler))
+	mux.Handle("POST /api/chirps", apiCfg.middlewareAuth(authRequired, apiCfg.AddChirpHandler))
+	mux.Handle("GET /api/search/chirps", apiCfg.middlewareAuth(authOptional, apiCfg.searchChirpsHandler))
+	mux.Handle("PUT /api/chirps/{chirpID}", apiCfg.middlewareAuth(authRequired, apiCfg.editChirpHandler))
+	mux.Handle("DELETE /api/chirps/{chirpID}", apiCfg.middlewareAuth(authRequired, apiCfg.deleteChirpByIdHandler))
+	mux.Handle("POST /api/chirps/{chirpID}/like", apiCfg.middlewareAuth(authRequired, apiCfg.likeChirpHandler))
+	mux.Handle("DELETE /api/chirps/{chirpID}/like", apiCfg.middlewareAuth(authRequired, apiCfg.unlikeChirpHandler))
+	mux.Handle("POST /api/chirps/{chirpID}/rechirp", apiCfg.middlewareAuth(authRequired, apiCfg.rechirpHandler))
+	mux.Handle("DELETE /api/chirps/{chirpID}/rechirp", apiCfg.middlewareAuth(authRequired, apiCfg.unrechirpHandler))
+	mux.Handle("POST /api/users", apiCfg.middlewareAuth(authForbidden, apiCfg.CreateUserHandler))
+	mux.Handle("PATCH /api/users", apiCfg.middlewareAuth(authRequired, apiCfg.updateUserHandler))
+	// PUT predates partial updates and behaves the same
+	mux.Handle("PUT /api/users", apiCfg.middlewareAuth(authRequired, apiCfg.updateUserHandler))
+	mux.Handle("DELETE /api/users", apiCfg.middlewareAuth(authRequired, apiCfg.deleteUserHandler))
+	mux.Handle("POST /api/users/restore", apiCfg.middlewareAuth(authForbidden, apiCfg.restoreUserHandler))
+	mux.Handle("GET /api/users/{idOrHandle}", apiCfg.middlewareAuth(authOptional, apiCfg.getUserProfileHandler))
+	mux.Handle("GET /api/users/{idOrHandle}/followers", apiCfg.middlewareAuth(authOptional, apiCfg.listFollowersHandler))
+	mux.Handle("GET /api/users/{idOrHandle}/following", apiCfg.middlewareAuth(authOptional, apiCfg.listFollowingHandler))
+	mux.Handle("POST /api/users/{idOrHandle}/follow", apiCfg.middlewareAuth(authRequired, apiCfg.followUserHandler))
+	mux.Handle("DELETE /api/users/{idOrHandle}/follow", apiCfg.middlewareAuth(authRequired, apiCfg.unfollowUserHandler))
+	mux.Handle("GET /api/timeline", apiCfg.middlewareAuth(authRequired, apiCfg.timelineHandler))
+	mux.Handle("GET /api/users/verify", apiCfg.middlewareAuth(authOptional, apiCfg.verifyEmailHandler))
+	mux.Handle("POST /api/users/verify", apiCfg.middlewareAuth(authOptional, apiCfg.verifyEmailHandler))
+	mux.Handle("POST /api/users/verify/resend", apiCfg.middlewareAuth(authRequired, apiCfg.resendEmailVerificationHandler))
+	mux.Handle("POST /api/login", apiCfg.middlewareAuth(authForbidden, apiCfg.LoginUserHandler))
+	mux.Handle("POST /api/login/mfa", apiCfg.middlewareAuth(authForbidden, apiCfg.mfaLoginHandler))
+	mux.Handle("POST /api/mfa/totp/enroll", apiCfg.middlewareAuth(authRequired, apiCfg.enrollTOTPHandler))
+	mux.Handle("POST /api/mfa/totp/confirm", apiCfg.middlewareAuth(authRequired, apiCfg.confirmTOTPHandler))
+	mux.Handle("POST /api/mfa/totp/disable", apiCfg.middlewareAuth(authRequired, apiCfg.disableTOTPHandler))
+	mux.Handle("POST /api/password-reset/request", apiCfg.middlewareAuth(authForbidden, apiCfg.requestPasswordResetHandler))
+	mux.Handle("POST /api/password-reset/confirm", apiCfg.middlewareAuth(authForbidden, apiCfg.confirmPasswordResetHandler))
+	mux.Handle("POST /api/tokens", apiCfg.middlewareAuth(authRequired, apiCfg.createPersonalAccessTokenHandler))
+	mux.Handle("GET /api/tokens", apiCfg.middlewareAuth(authRequired, apiCfg.listPersonalAccessTokensHandler))
+	mux.Handle("DELETE /api/tokens/{tokenID}", apiCfg.middlewareAuth(authRequired, apiCfg.revokePersonalAccessTokenHandler))
+	mux.Handle("GET /api/oidc/{provider}/login", apiCfg.middlewareAuth(authForbidden, apiCfg.oidcLoginHandler))
+	mux.Handle("GET /api/oidc/{provider}/callback", apiCfg.middlewareAuth(authForbidden, apiCfg.oidcCallbackHandler))
+	mux.Handle("POST /api/oidc/{provider}/link", apiCfg.middlewareAuth(authRequired, apiCfg.oidcLinkHandler))
+	mux.Handle("GET /api/identities", apiCfg.middlewareAuth(authRequired, apiCfg.listIdentitiesHandler))
+	mux.Handle("DELETE /api/identities/{identityID}", apiCfg.middlewareAuth(authRequired, apiCfg.deleteIdentityHandler))
+	mux.Handle("POST /api/oauth/clients", apiCfg.middlewareAuth(authRequired, apiCfg.createOAuthClientHandler))
+	mux.Handle("GET /api/oauth/clients", apiCfg.middlewareAuth(authRequired, apiCfg.listOAuthClientsHandler))
+	mux.Handle("DELETE /api/oauth/clients/{clientID}", apiCfg.middlewareAuth(authRequired, apiCfg.deleteOAuthClientHandler))
+	mux.Handle("GET /api/oauth/authorizations", apiCfg.middlewareAuth(authRequired, apiCfg.listAuthorizedAppsHandler))
+	mux.Handle("DELETE /api/oauth/authorizations/{clientID}", apiCfg.middlewareAuth(authRequired, apiCfg.revokeAuthorizedAppHandler))
+	mux.Handle("GET /oauth/authorize", apiCfg.middlewareAuth(authRequired, apiCfg.authorizeHandler))
+	mux.Handle("POST /oauth/authorize", apiCfg.middlewareAuth(authRequired, apiCfg.authorizeConsentHandler))
+	mux.Handle("GET /api/sessions", apiCfg.middlewareAuth(authRequired, apiCfg.listSessionsHandler))
+	mux.Handle("DELETE /api/sessions/{sessionID}", apiCfg.middlewareAuth(authRequired, apiCfg.revokeSessionHandler))
+	mux.Handle("POST /api/sessions/revoke-all", apiCfg.middlewareAuth(authRequired, apiCfg.revokeAllSessionsHandler))
+
+	// These carry their own credentials in the Authorization header or a cookie:
+	// a refresh token, an OAuth client secret, or the Polka API key
 	mux.HandleFunc("POST /api/refresh", apiCfg.RefreshTokenHandler)
 	mux.HandleFunc("POST /api/revoke", apiCfg.RevokeTokenHandler)
-	mux.HandleFunc("GET /admin/metrics", apiCfg.metricsHandler)
-	mux.HandleFunc("POST /admin/reset", apiCfg.resetMetricsHandler)
-	mux.HandleFunc("PUT /api/users", apiCfg.updateUserHandler)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.deleteChirpByIdHandler)
+	mux.HandleFunc("POST /oauth/token", apiCfg.tokenHandler)
 	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.polkaWebhookHandler)
 
+	mux.Handle("GET /admin/metrics", apiCfg.middlewareRequireRole(auth.RoleAdmin, apiCfg.metricsHandler))
+	mux.Handle("POST /admin/reset", apiCfg.middlewareRequireRole(auth.RoleAdmin, apiCfg.resetMetricsHandler))
+	mux.Handle("POST /admin/users/{userID}/unlock", apiCfg.middlewareRequireRole(auth.RoleAdmin, apiCfg.unlockUserHandler))
+	mux.Handle("PUT /admin/users/{userID}/role", apiCfg.middlewareRequireRole(auth.RoleAdmin, apiCfg.updateUserRoleHandler))
+	mux.Handle("DELETE /admin/users/{userID}", apiCfg.middlewareRequireRole(auth.RoleAdmin, apiCfg.adminDeleteUserHandler))
+	mux.Handle("POST /admin/users/{userID}/restore", apiCfg.middlewareRequireRole(auth.RoleAdmin, apiCfg.adminRestoreUserHandler))
+
 	server := &http.Server{
 		Addr:    "127.0.0.1:8080", // forces WSL2 to use IPv4
 		Handler: mux,
@@ -69,3 +214,62 @@ func main() {
 		fmt.Println(err)
 	}
 }
+
+// loadJWTKeys reads the signing keys from JWT_KEYS_DIR, signing with JWT_ACTIVE_KID.
+// Without a key directory a throwaway key is generated, which is fine for local
+// development but logs everyone out on restart.
+func loadJWTKeys() (*auth.KeyRing, error) {
+	keysDir := os.Getenv("JWT_KEYS_DIR")
+
+	if keysDir == "" {
+		fmt.Println("JWT_KEYS_DIR is not set, using an ephemeral signing key")
+		return auth.NewEphemeralKeyRing()
+	}
+
+	return auth.LoadKeyRing(keysDir, os.Getenv("JWT_ACTIVE_KID"))
+}
+
+// newMailer writes outgoing mail to MAILER_DIR if set, and to the log otherwise.
+func newMailer() mailer.Mailer {
+	mailDir := os.Getenv("MAILER_DIR")
+
+	if mailDir != "" {
+		return mailer.FileMailer{Dir: mailDir}
+	}
+
+	return mailer.LogMailer{}
+}
+
+// loadOIDCProviders reads the identity providers users can sign in with from
+// the JSON file at OIDC_PROVIDERS_FILE. Without it, only passwords work.
+func loadOIDCProviders() (map[string]*oidc.Provider, error) {
+	path := os.Getenv("OIDC_PROVIDERS_FILE")
+
+	if path == "" {
+		return map[string]*oidc.Provider{}, nil
+	}
+
+	return oidc.LoadProviders(path, nil)
+}
+
+func promoteAdmin(dbQueries *database.Queries, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: chirpy promote-admin <email>")
+	}
+
+	n, err := dbQueries.SetUserRoleByEmail(context.Background(), database.SetUserRoleByEmailParams{
+		Email: args[0],
+		Role:  string(auth.RoleAdmin),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("no user with email %s", args[0])
+	}
+
+	fmt.Printf("%s is now an admin\n", args[0])
+	return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+)
+
+// How long the user has to enter their TOTP code after the password step
+const mfaChallengeExpiration = 5 * time.Minute
+
+const recoveryCodeCount = 10
+
+var errInvalidSecondFactor = errors.New("invalid TOTP or recovery code")
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+// Both are consumed, so the same code cannot be used twice.
+func checkSecondFactor(ctx context.Context, q *database.Queries, user database.User, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		n, err := q.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+			CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)),
+			UserID:   user.ID,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return errInvalidSecondFactor
+		}
+
+		return nil
+	}
+
+	step, err := auth.ValidateTOTP(user.TotpSecret.String, code, time.Now())
+
+	if err != nil {
+		return errInvalidSecondFactor
+	}
+
+	n, err := q.UseUserTOTPStep(ctx, database.UseUserTOTPStepParams{
+		ID:               user.ID,
+		TotpLastUsedStep: sql.NullInt64{Int64: step, Valid: true},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		// The code was valid, but it has been used already
+		return errInvalidSecondFactor
+	}
+
+	return nil
+}
+
+// enrollTOTPHandler starts two-factor enrollment by generating a new secret.
+// It stays inactive until the user proves their app works with confirmTOTPHandler.
+func (cfg *apiConfig) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), caller.UserID)
+
+	if err != nil {
+		respondWithError(w, 404, "User not found in database")
+		return
+	}
+
+	if user.TotpEnabledAt.Valid {
+		respondWithError(w, 409, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+
+	if err != nil {
+		respondWithError(w, 500, "Error generating TOTP secret")
+		return
+	}
+
+	err = cfg.DB.SetUserTOTPSecret(r.Context(), database.SetUserTOTPSecretParams{
+		ID:         user.ID,
+		TotpSecret: sql.NullString{String: secret, Valid: true},
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating user in database")
+		return
+	}
+
+	respBody := struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}{
+		Secret:     secret,
+		OtpauthURI: auth.TOTPURI("Chirpy", user.Email, secret),
+	}
+
+	respondWithJSON(w, 200, respBody)
+}
+
+// confirmTOTPHandler enables two-factor authentication once the user sends a
+// valid code for the enrolled secret, and returns the recovery codes.
+// The codes are only stored hashed, so this is the only time they are shown.
+func (cfg *apiConfig) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
+
+	if err != nil {
+		respondWithError(w, 500, "Error starting transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	user, err := qtx.GetUserById(r.Context(), caller.UserID)
+
+	if err != nil {
+		respondWithError(w, 404, "User not found in database")
+		return
+	}
+
+	if user.TotpEnabledAt.Valid {
+		respondWithError(w, 409, "Two-factor authentication is already enabled")
+		return
+	}
+
+	if !user.TotpSecret.Valid {
+		respondWithError(w, 400, "Two-factor enrollment has not been started")
+		return
+	}
+
+	err = checkSecondFactor(r.Context(), qtx, user, params.Code, "")
+
+	if errors.Is(err, errInvalidSecondFactor) {
+		respondWithError(w, 401, "Invalid TOTP code")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error checking TOTP code")
+		return
+	}
+
+	err = qtx.EnableUserTOTP(r.Context(), user.ID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating user in database")
+		return
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+
+	if err != nil {
+		respondWithError(w, 500, "Error generating recovery codes")
+		return
+	}
+
+	err = qtx.DeleteRecoveryCodesByUserId(r.Context(), user.ID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error deleting old recovery codes")
+		return
+	}
+
+	for _, code := range recoveryCodes {
+		err = qtx.CreateRecoveryCode(r.Context(), database.CreateRecoveryCodeParams{
+			CodeHash: auth.HashToken(code),
+			UserID:   user.ID,
+		})
+
+		if err != nil {
+			respondWithError(w, 500, "Error storing recovery codes")
+			return
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		respondWithError(w, 500, "Error committing two-factor enrollment")
+		return
+	}
+
+	respBody := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: recoveryCodes,
+	}
+
+	respondWithJSON(w, 200, respBody)
+}
+
+// disableTOTPHandler turns two-factor authentication off.
+// It needs a current TOTP code or a recovery code, not just a JWT.
+func (cfg *apiConfig) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
+
+	if err != nil {
+		respondWithError(w, 500, "Error starting transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	user, err := qtx.GetUserById(r.Context(), caller.UserID)
+
+	if err != nil {
+		respondWithError(w, 404, "User not found in database")
+		return
+	}
+
+	if !user.TotpEnabledAt.Valid {
+		respondWithError(w, 409, "Two-factor authentication is not enabled")
+		return
+	}
+
+	err = checkSecondFactor(r.Context(), qtx, user, params.Code, params.RecoveryCode)
+
+	if errors.Is(err, errInvalidSecondFactor) {
+		respondWithError(w, 401, "Invalid TOTP or recovery code")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error checking TOTP code")
+		return
+	}
+
+	err = qtx.DisableUserTOTP(r.Context(), user.ID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating user in database")
+		return
+	}
+
+	err = qtx.DeleteRecoveryCodesByUserId(r.Context(), user.ID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error deleting recovery codes")
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		respondWithError(w, 500, "Error committing two-factor removal")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// respondWithMFAChallenge answers the first login step of a user with
+// two-factor authentication with the token for mfaLoginHandler.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, user database.User) {
+	mfaToken, err := auth.MakeMFAChallengeToken(user.ID, cfg.jwtKeys, mfaChallengeExpiration)
+
+	if err != nil {
+		log.Printf("Error creating MFA challenge token: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	respBody := struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	}
+
+	respondWithJSON(w, 200, respBody)
+}
+
+// mfaLoginHandler is the second login step for users with two-factor
+// authentication. It exchanges the MFA challenge token from LoginUserHandler
+// plus a TOTP or recovery code for the usual JWT and refresh token.
+func (cfg *apiConfig) mfaLoginHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		UseCookies   bool   `json:"use_cookies"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	userID, err := auth.ValidateMFAChallengeToken(params.MFAToken, cfg.jwtKeys)
+
+	if err != nil {
+		respondWithError(w, 401, "Invalid or expired MFA token")
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), userID)
+
+	if err != nil {
+		respondWithError(w, 401, "Invalid or expired MFA token")
+		return
+	}
+
+	if !user.TotpEnabledAt.Valid {
+		respondWithError(w, 401, "Two-factor authentication is not enabled")
+		return
+	}
+
+	// TOTP codes are short, so guesses count against the same limits as passwords
+	ip := cfg.clientIP(r)
+
+	lock, err := cfg.loginLockedFor(r.Context(), accountThrottleKey(user.Email), ipThrottleKey(ip))
+
+	if err != nil {
+		respondWithError(w, 500, "Error checking login throttle")
+		return
+	}
+
+	if lock > 0 {
+		respondLoginLocked(w, lock)
+		return
+	}
+
+	err = checkSecondFactor(r.Context(), cfg.DB, user, params.Code, params.RecoveryCode)
+
+	if errors.Is(err, errInvalidSecondFactor) {
+		log.Printf("Invalid second factor for user %s", user.ID)
+		cfg.recordFailedLogin(r.Context(), user.Email, ip)
+		respondWithError(w, 401, "Invalid TOTP or recovery code")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, 500, "Error checking TOTP code")
+		return
+	}
+
+	// The account may have been deleted since the first step
+	if user.DeletedAt.Valid {
+		respondWithError(w, 403, accountDeletedMessage)
+		return
+	}
+
+	cfg.clearLoginFailures(r.Context(), user.Email)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	cfg.respondWithSession(w, r, user, params.UseCookies)
+}
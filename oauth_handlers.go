@@ -0,0 +1,717 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
+	"github.com/google/uuid"
+)
+
+// Third-party apps act on behalf of users through OAuth 2.0 (RFC 6749):
+// the user approves the app at /oauth/authorize, and the app exchanges the
+// resulting code at /oauth/token for an access token limited to the granted
+// scopes plus a refresh token. PKCE (RFC 7636) is required of every app.
+
+type OAuthClient struct {
+	ID           uuid.UUID `json:"client_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	// Only set in the response to the registration request
+	Secret string `json:"client_secret,omitempty"`
+}
+
+func toOAuthClient(client database.OauthClient) OAuthClient {
+	return OAuthClient{
+		ID:           client.ID,
+		CreatedAt:    client.CreatedAt,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectUris,
+		Scopes:       client.Scopes,
+		Confidential: client.SecretHash.Valid,
+	}
+}
+
+// oauthError is an error response in the format of RFC 6749 section 5.2.
+type oauthError struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func respondWithOAuthError(w http.ResponseWriter, err error) {
+	oauthErr := &oauthError{}
+
+	if !errors.As(err, &oauthErr) {
+		log.Printf("OAuth request failed: %s", err)
+		oauthErr = &oauthError{Status: 500, Code: "server_error", Description: "Internal server error"}
+	}
+
+	respBody := struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{
+		Error:            oauthErr.Code,
+		ErrorDescription: oauthErr.Description,
+	}
+
+	respondWithJSON(w, oauthErr.Status, respBody)
+}
+
+// validRedirectURI accepts https URIs, and http on a loopback address, where
+// native apps receive the code (RFC 8252 section 7.3).
+func validRedirectURI(rawURI string) bool {
+	u, err := url.Parse(rawURI)
+
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+
+	if u.Scheme == "https" {
+		return true
+	}
+
+	host := u.Hostname()
+	return u.Scheme == "http" && (host == "localhost" || host == "127.0.0.1" || host == "::1")
+}
+
+// createOAuthClientHandler registers an app. Confidential apps, which run on
+// a server, get a secret that is only shown in this response.
+func (cfg *apiConfig) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	if params.Name == "" {
+		respondWithError(w, 400, "Name is required")
+		return
+	}
+
+	if len(params.RedirectURIs) == 0 {
+		respondWithError(w, 400, "At least one redirect URI is required")
+		return
+	}
+
+	for _, redirectURI := range params.RedirectURIs {
+		if !validRedirectURI(redirectURI) {
+			respondWithError(w, 400, "Invalid redirect URI: "+redirectURI)
+			return
+		}
+	}
+
+	scopes, err := auth.ValidateScopes(params.Scopes)
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	secret := ""
+	secretHash := sql.NullString{}
+
+	if params.Confidential {
+		secret, err = auth.MakeClientSecret()
+
+		if err != nil {
+			respondWithError(w, 500, "Error creating client secret")
+			return
+		}
+
+		secretHash = sql.NullString{String: auth.HashToken(secret), Valid: true}
+	}
+
+	client, err := cfg.DB.CreateOAuthClient(r.Context(), database.CreateOAuthClientParams{
+		UserID:       caller.UserID,
+		Name:         params.Name,
+		SecretHash:   secretHash,
+		RedirectUris: params.RedirectURIs,
+		Scopes:       scopes,
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error storing OAuth client")
+		return
+	}
+
+	respBody := toOAuthClient(client)
+	respBody.Secret = secret
+
+	respondWithJSON(w, 201, respBody)
+}
+
+func (cfg *apiConfig) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	beforeCreatedAt, beforeID := cursorArgs(page.After)
+
+	clients, err := cfg.DB.ListOAuthClientsByUserId(r.Context(), database.ListOAuthClientsByUserIdParams{
+		UserID:          caller.UserID,
+		BeforeCreatedAt: beforeCreatedAt,
+		BeforeID:        beforeID,
+		PageSize:        int32(page.Limit + 1),
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving OAuth clients from database")
+		return
+	}
+
+	clients, next := pagination.Cut(clients, page, func(client database.OauthClient) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: client.CreatedAt, ID: client.ID}
+	})
+
+	respBody := make([]OAuthClient, len(clients))
+
+	for i, client := range clients {
+		respBody[i] = toOAuthClient(client)
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
+
+// deleteOAuthClientHandler removes an app along with every token issued to it.
+// Its access tokens are rejected from then on, as authenticate checks that
+// the app still exists.
+func (cfg *apiConfig) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, err := uuid.Parse(r.PathValue("clientID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid clientID")
+		return
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	n, err := cfg.DB.DeleteOAuthClient(r.Context(), database.DeleteOAuthClientParams{
+		ID:     clientID,
+		UserID: caller.UserID,
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error deleting OAuth client")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 404, "OAuth client not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// listAuthorizedAppsHandler lists the apps the user has given access to.
+func (cfg *apiConfig) listAuthorizedAppsHandler(w http.ResponseWriter, r *http.Request) {
+	type authorizedApp struct {
+		ClientID     uuid.UUID `json:"client_id"`
+		Name         string    `json:"name"`
+		AuthorizedAt time.Time `json:"authorized_at"`
+		LastUsedAt   time.Time `json:"last_used_at"`
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	beforeAuthorizedAt, beforeID := cursorArgs(page.After)
+
+	apps, err := cfg.DB.ListAuthorizedClientsByUserId(r.Context(), database.ListAuthorizedClientsByUserIdParams{
+		UserID:             caller.UserID,
+		BeforeAuthorizedAt: beforeAuthorizedAt,
+		BeforeID:           beforeID,
+		PageSize:           int32(page.Limit + 1),
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving authorized apps from database")
+		return
+	}
+
+	apps, next := pagination.Cut(apps, page, func(app database.ListAuthorizedClientsByUserIdRow) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: app.AuthorizedAt, ID: app.ID}
+	})
+
+	respBody := make([]authorizedApp, len(apps))
+
+	for i, app := range apps {
+		respBody[i] = authorizedApp{
+			ClientID:     app.ID,
+			Name:         app.Name,
+			AuthorizedAt: app.AuthorizedAt,
+			LastUsedAt:   app.LastUsedAt,
+		}
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
+
+// revokeAuthorizedAppHandler takes away an app's access. Access tokens that
+// were already issued stay valid until they expire.
+func (cfg *apiConfig) revokeAuthorizedAppHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, err := uuid.Parse(r.PathValue("clientID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid clientID")
+		return
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	n, err := cfg.DB.RevokeClientAuthorization(r.Context(), database.RevokeClientAuthorizationParams{
+		ClientID: uuid.NullUUID{UUID: clientID, Valid: true},
+		UserID:   caller.UserID,
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error revoking app access")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 404, "App not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// authorizationRequest holds the parameters of an authorization request
+// (RFC 6749 section 4.1.1 and RFC 7636 section 4.3).
+type authorizationRequest struct {
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// checkAuthorizationRequest returns the app asking for access, the scopes it
+// asks for and where to send the user back to. Without a scope the app asks
+// for everything it was registered for, and without a redirect URI for its
+// only one.
+func (cfg *apiConfig) checkAuthorizationRequest(r *http.Request, req authorizationRequest) (database.OauthClient, []string, string, error) {
+	clientID, err := uuid.Parse(req.ClientID)
+
+	if err != nil {
+		return database.OauthClient{}, nil, "", &oauthError{400, "invalid_request", "Invalid client_id"}
+	}
+
+	client, err := cfg.DB.GetOAuthClient(r.Context(), clientID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.OauthClient{}, nil, "", &oauthError{400, "invalid_request", "Unknown client_id"}
+	}
+
+	if err != nil {
+		return database.OauthClient{}, nil, "", err
+	}
+
+	redirectURI := req.RedirectURI
+
+	if redirectURI == "" && len(client.RedirectUris) == 1 {
+		redirectURI = client.RedirectUris[0]
+	}
+
+	if !slices.Contains(client.RedirectUris, redirectURI) {
+		return database.OauthClient{}, nil, "", &oauthError{400, "invalid_request", "redirect_uri is not registered for this client"}
+	}
+
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return database.OauthClient{}, nil, "", &oauthError{400, "invalid_request", "A code_challenge with code_challenge_method S256 is required"}
+	}
+
+	scopes := client.Scopes
+
+	if req.Scope != "" {
+		scopes, err = auth.ValidateScopes(strings.Fields(req.Scope))
+
+		if err != nil {
+			return database.OauthClient{}, nil, "", &oauthError{400, "invalid_scope", err.Error()}
+		}
+
+		for _, scope := range scopes {
+			if !slices.Contains(client.Scopes, scope) {
+				return database.OauthClient{}, nil, "", &oauthError{400, "invalid_scope", "Client is not registered for scope " + scope}
+			}
+		}
+	}
+
+	return client, scopes, redirectURI, nil
+}
+
+// authorizeHandler checks an authorization request and describes it, so the
+// web app can ask the logged in user for consent.
+func (cfg *apiConfig) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireLogin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	if query.Get("response_type") != "code" {
+		respondWithOAuthError(w, &oauthError{400, "unsupported_response_type", "Only the code response type is supported"})
+		return
+	}
+
+	client, scopes, redirectURI, err := cfg.checkAuthorizationRequest(r, authorizationRequest{
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	})
+
+	if err != nil {
+		respondWithOAuthError(w, err)
+		return
+	}
+
+	respBody := struct {
+		ClientID    uuid.UUID `json:"client_id"`
+		ClientName  string    `json:"client_name"`
+		Scopes      []string  `json:"scopes"`
+		RedirectURI string    `json:"redirect_uri"`
+	}{
+		ClientID:    client.ID,
+		ClientName:  client.Name,
+		Scopes:      scopes,
+		RedirectURI: redirectURI,
+	}
+
+	respondWithJSON(w, 200, respBody)
+}
+
+// authorizeConsentHandler records the user's answer to an authorization request.
+// It responds with the URL to send the user back to the app with, carrying
+// either a code or an access_denied error.
+func (cfg *apiConfig) authorizeConsentHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	client, scopes, redirectURI, err := cfg.checkAuthorizationRequest(r, params.authorizationRequest)
+
+	if err != nil {
+		respondWithOAuthError(w, err)
+		return
+	}
+
+	callback, err := url.Parse(redirectURI)
+
+	if err != nil {
+		respondWithError(w, 500, "Invalid redirect URI")
+		return
+	}
+
+	callbackQuery := callback.Query()
+
+	if params.State != "" {
+		callbackQuery.Set("state", params.State)
+	}
+
+	if !params.Approve {
+		callbackQuery.Set("error", "access_denied")
+	} else {
+		code, err := auth.MakeAuthorizationCode()
+
+		if err != nil {
+			respondWithError(w, 500, "Error creating authorization code")
+			return
+		}
+
+		err = cfg.DB.CreateOAuthAuthorizationCode(r.Context(), database.CreateOAuthAuthorizationCodeParams{
+			CodeHash:      auth.HashToken(code),
+			ClientID:      client.ID,
+			UserID:        caller.UserID,
+			RedirectUri:   redirectURI,
+			Scopes:        scopes,
+			CodeChallenge: params.CodeChallenge,
+		})
+
+		if err != nil {
+			respondWithError(w, 500, "Error storing authorization code")
+			return
+		}
+
+		callbackQuery.Set("code", code)
+	}
+
+	callback.RawQuery = callbackQuery.Encode()
+
+	respBody := struct {
+		RedirectURI string `json:"redirect_uri"`
+	}{
+		RedirectURI: callback.String(),
+	}
+
+	respondWithJSON(w, 200, respBody)
+}
+
+// authenticateClient identifies the app calling the token endpoint, by HTTP
+// Basic authentication or client_id and client_secret in the form.
+// Public clients only give their client_id.
+func (cfg *apiConfig) authenticateClient(r *http.Request) (database.OauthClient, error) {
+	clientIDString, secret, ok := r.BasicAuth()
+
+	if ok {
+		clientIDString, _ = url.QueryUnescape(clientIDString)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientIDString, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	invalidClient := &oauthError{401, "invalid_client", "Client authentication failed"}
+
+	clientID, err := uuid.Parse(clientIDString)
+
+	if err != nil {
+		return database.OauthClient{}, invalidClient
+	}
+
+	client, err := cfg.DB.GetOAuthClient(r.Context(), clientID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.OauthClient{}, invalidClient
+	}
+
+	if err != nil {
+		return database.OauthClient{}, err
+	}
+
+	if client.SecretHash.Valid && subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(client.SecretHash.String)) != 1 {
+		return database.OauthClient{}, invalidClient
+	}
+
+	return client, nil
+}
+
+// tokenHandler is the OAuth token endpoint, for the authorization_code and
+// refresh_token grants. Refresh tokens rotate as they do for logins.
+func (cfg *apiConfig) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	client, err := cfg.authenticateClient(r)
+
+	if err != nil {
+		if _, _, ok := r.BasicAuth(); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		}
+
+		respondWithOAuthError(w, err)
+		return
+	}
+
+	var refreshToken database.RefreshToken
+	var newRefreshToken string
+
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		refreshToken, newRefreshToken, err = cfg.redeemAuthorizationCode(r, client)
+	case "refresh_token":
+		refreshToken, newRefreshToken, err = cfg.rotateRefreshToken(r, r.PostFormValue("refresh_token"), uuid.NullUUID{UUID: client.ID, Valid: true})
+
+		if errors.Is(err, errRefreshTokenNotFound) || errors.Is(err, errRefreshTokenRevoked) || errors.Is(err, errRefreshTokenExpired) {
+			err = &oauthError{400, "invalid_grant", "Invalid refresh token"}
+		}
+	default:
+		err = &oauthError{400, "unsupported_grant_type", "Only the authorization_code and refresh_token grants are supported"}
+	}
+
+	if err != nil {
+		respondWithOAuthError(w, err)
+		return
+	}
+
+	accessToken, err := auth.MakeScopedJWT(refreshToken.UserID, cfg.jwtKeys, accessTokenExpiration, client.ID, refreshToken.Scopes)
+
+	if err != nil {
+		respondWithOAuthError(w, err)
+		return
+	}
+
+	respBody := struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenExpiration.Seconds()),
+		RefreshToken: newRefreshToken,
+		Scope:        strings.Join(refreshToken.Scopes, " "),
+	}
+
+	respondWithJSON(w, 200, respBody)
+}
+
+// redeemAuthorizationCode exchanges a code for the first refresh token of a new
+// family. A code presented a second time revokes the tokens it was redeemed
+// for, as it has probably been intercepted (RFC 6749 section 4.1.2).
+func (cfg *apiConfig) redeemAuthorizationCode(r *http.Request, client database.OauthClient) (database.RefreshToken, string, error) {
+	invalidGrant := &oauthError{400, "invalid_grant", "Invalid authorization code"}
+
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
+
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	code, err := qtx.GetOAuthAuthorizationCodeForUpdate(r.Context(), auth.HashToken(r.PostFormValue("code")))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.RefreshToken{}, "", invalidGrant
+	}
+
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+
+	if code.ClientID != client.ID {
+		return database.RefreshToken{}, "", invalidGrant
+	}
+
+	if code.UsedAt.Valid {
+		if code.FamilyID.Valid {
+			err = qtx.RevokeRefreshTokenFamily(r.Context(), code.FamilyID.UUID)
+
+			if err != nil {
+				return database.RefreshToken{}, "", err
+			}
+
+			err = tx.Commit()
+
+			if err != nil {
+				return database.RefreshToken{}, "", err
+			}
+		}
+
+		log.Printf("Authorization code reuse detected for client %s", client.ID)
+		return database.RefreshToken{}, "", invalidGrant
+	}
+
+	if time.Now().After(code.ExpiresAt) || code.RedirectUri != r.PostFormValue("redirect_uri") {
+		return database.RefreshToken{}, "", invalidGrant
+	}
+
+	if !auth.VerifyCodeChallenge(r.PostFormValue("code_verifier"), code.CodeChallenge) {
+		return database.RefreshToken{}, "", invalidGrant
+	}
+
+	newRefreshToken, err := auth.MakeRefreshToken()
+
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+
+	refreshToken, err := qtx.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
+		TokenHash: auth.HashToken(newRefreshToken),
+		UserID:    code.UserID,
+		FamilyID:  uuid.New(),
+		UserAgent: sessionUserAgent(r),
+		IpAddress: cfg.clientIP(r),
+		ClientID:  uuid.NullUUID{UUID: client.ID, Valid: true},
+		Scopes:    code.Scopes,
+	})
+
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+
+	err = qtx.MarkOAuthAuthorizationCodeUsed(r.Context(), database.MarkOAuthAuthorizationCodeUsedParams{
+		CodeHash: code.CodeHash,
+		FamilyID: uuid.NullUUID{UUID: refreshToken.FamilyID, Valid: true},
+	})
+
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+
+	return refreshToken, newRefreshToken, tx.Commit()
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/oidc"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
+	"github.com/google/uuid"
+)
+
+// The browser carries the state of a sign-in with an identity provider in this
+// cookie, so a callback URL only completes in the browser that started it.
+// It is sent along on the top-level redirect back from the provider, which
+// SameSite=Strict would prevent.
+const oidcStateCookie = "chirpy_oidc_state"
+
+// Same as the expiry of oidc_login_states rows
+const oidcLoginExpiration = 10 * time.Minute
+
+var errIdentityEmailTaken = errors.New("an account with this email already exists")
+
+type UserIdentity struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+}
+
+func toUserIdentity(identity database.UserIdentity) UserIdentity {
+	return UserIdentity{
+		ID:        identity.ID,
+		CreatedAt: identity.CreatedAt,
+		Provider:  identity.Provider,
+		Email:     identity.Email,
+	}
+}
+
+func (cfg *apiConfig) oidcProvider(w http.ResponseWriter, r *http.Request) (*oidc.Provider, bool) {
+	provider, ok := cfg.oidcProviders[r.PathValue("provider")]
+
+	if !ok {
+		respondWithError(w, 404, "Unknown identity provider")
+		return nil, false
+	}
+
+	return provider, true
+}
+
+// startOIDCLogin stores a pending sign-in and returns the provider's URL to
+// send the user to. With a userID, the identity is linked to that user instead.
+func (cfg *apiConfig) startOIDCLogin(w http.ResponseWriter, r *http.Request, provider *oidc.Provider, userID uuid.NullUUID, useCookies bool) (string, error) {
+	state, err := oidc.NewState()
+
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := oidc.NewNonce()
+
+	if err != nil {
+		return "", err
+	}
+
+	codeVerifier, err := oidc.NewCodeVerifier()
+
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, oidc.CodeChallenge(codeVerifier))
+
+	if err != nil {
+		return "", err
+	}
+
+	err = cfg.DB.CreateOIDCLoginState(r.Context(), database.CreateOIDCLoginStateParams{
+		StateHash:    auth.HashToken(state),
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		UserID:       userID,
+		UseCookies:   useCookies,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcLoginExpiration.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return authURL, nil
+}
+
+// oidcLoginHandler sends the browser to the identity provider to sign in.
+// Add ?use_cookies=true for a cookie session at the end, as with /api/login.
+func (cfg *apiConfig) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cfg.oidcProvider(w, r)
+
+	if !ok {
+		return
+	}
+
+	authURL, err := cfg.startOIDCLogin(w, r, provider, uuid.NullUUID{}, r.URL.Query().Get("use_cookies") == "true")
+
+	if err != nil {
+		log.Printf("Error starting sign-in with %s: %s", provider.Name, err)
+		respondWithError(w, 502, "Error contacting the identity provider")
+		return
+	}
+
+	http.Redirect(w, r, authURL, 302)
+}
+
+// oidcLinkHandler starts linking an identity to the logged in user. The client
+// sends the user to the returned URL; the callback then adds the identity.
+func (cfg *apiConfig) oidcLinkHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cfg.oidcProvider(w, r)
+
+	if !ok {
+		return
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	authURL, err := cfg.startOIDCLogin(w, r, provider, uuid.NullUUID{UUID: caller.UserID, Valid: true}, false)
+
+	if err != nil {
+		log.Printf("Error starting sign-in with %s: %s", provider.Name, err)
+		respondWithError(w, 502, "Error contacting the identity provider")
+		return
+	}
+
+	respBody := struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}{
+		AuthorizationURL: authURL,
+	}
+
+	respondWithJSON(w, 200, respBody)
+}
+
+// oidcCallbackHandler is where the identity provider sends the user back to.
+// It redeems the code and logs the user in like /api/login, or finishes linking.
+func (cfg *apiConfig) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cfg.oidcProvider(w, r)
+
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+
+	if query.Get("error") != "" {
+		respondWithError(w, 400, "Sign-in was not completed: "+query.Get("error"))
+		return
+	}
+
+	state := query.Get("state")
+	stateCookie, err := r.Cookie(oidcStateCookie)
+
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(state)) != 1 {
+		respondWithError(w, 400, "Invalid sign-in state")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	loginState, err := cfg.DB.ConsumeOIDCLoginState(r.Context(), auth.HashToken(state))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 400, "Invalid sign-in state")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving sign-in state: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if loginState.Provider != provider.Name || time.Now().After(loginState.ExpiresAt) {
+		respondWithError(w, 400, "Sign-in has expired, please try again")
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), loginState.CodeVerifier, loginState.Nonce)
+
+	if err != nil {
+		log.Printf("Error completing sign-in with %s: %s", provider.Name, err)
+		respondWithError(w, 401, "Could not verify the sign-in with the identity provider")
+		return
+	}
+
+	if loginState.UserID.Valid {
+		cfg.linkIdentity(w, r, provider.Name, claims, loginState.UserID.UUID)
+		return
+	}
+
+	user, created, err := cfg.userForIdentity(r.Context(), provider.Name, claims)
+
+	if errors.Is(err, errIdentityEmailTaken) {
+		respondWithError(w, 409, "An account with this email already exists. Log in and link the identity provider from your account instead")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error finding user for identity: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if created && !user.EmailVerifiedAt.Valid {
+		err = cfg.sendEmailVerification(r.Context(), user.ID, user.Email)
+
+		if err != nil {
+			log.Printf("Error sending verification mail: %s", err)
+		}
+	}
+
+	if user.DeletedAt.Valid {
+		respondWithError(w, 403, accountDeletedMessage)
+		return
+	}
+
+	if !cfg.unverifiedPolicy.canLogIn(user) {
+		respondWithError(w, 403, "Verify your email address before logging in")
+		return
+	}
+
+	// The identity provider replaces the password, not the second factor
+	if user.TotpEnabledAt.Valid {
+		cfg.respondWithMFAChallenge(w, user)
+		return
+	}
+
+	cfg.respondWithSession(w, r, user, loginState.UseCookies)
+}
+
+// userForIdentity returns the user an external identity signs in as. The first
+// sign-in links the identity to the account with the same email, if both the
+// provider and we have verified the address, and creates an account otherwise.
+func (cfg *apiConfig) userForIdentity(ctx context.Context, provider string, claims *oidc.Claims) (user database.User, created bool, err error) {
+	tx, err := cfg.dbConn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return database.User{}, false, err
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	identity, err := qtx.GetUserIdentity(ctx, database.GetUserIdentityParams{
+		Provider: provider,
+		Subject:  claims.Subject,
+	})
+
+	if err == nil {
+		user, err = qtx.GetUserById(ctx, identity.UserID)
+		return user, false, err
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, false, err
+	}
+
+	user, err = qtx.GetUserByEmail(ctx, claims.Email)
+
+	switch {
+	case err == nil:
+		if !claims.EmailVerified || !user.EmailVerifiedAt.Valid {
+			return database.User{}, false, errIdentityEmailTaken
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		if !validEmail(claims.Email) {
+			return database.User{}, false, errors.New("identity provider did not share a valid email address")
+		}
+
+		user, err = qtx.CreateUser(ctx, database.CreateUserParams{
+			Email:          claims.Email,
+			HashedPassword: auth.UnusablePasswordHash,
+			Handle:         defaultHandle(),
+		})
+
+		if err != nil {
+			return database.User{}, false, err
+		}
+
+		if claims.EmailVerified {
+			err = qtx.VerifyUserEmail(ctx, database.VerifyUserEmailParams{
+				ID:    user.ID,
+				Email: user.Email,
+			})
+
+			if err != nil {
+				return database.User{}, false, err
+			}
+
+			user, err = qtx.GetUserById(ctx, user.ID)
+
+			if err != nil {
+				return database.User{}, false, err
+			}
+		}
+
+		created = true
+	default:
+		return database.User{}, false, err
+	}
+
+	_, err = qtx.CreateUserIdentity(ctx, database.CreateUserIdentityParams{
+		UserID:   user.ID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	})
+
+	if err != nil {
+		return database.User{}, false, err
+	}
+
+	return user, created, tx.Commit()
+}
+
+func (cfg *apiConfig) linkIdentity(w http.ResponseWriter, r *http.Request, provider string, claims *oidc.Claims, userID uuid.UUID) {
+	identity, err := cfg.DB.GetUserIdentity(r.Context(), database.GetUserIdentityParams{
+		Provider: provider,
+		Subject:  claims.Subject,
+	})
+
+	if err == nil {
+		if identity.UserID != userID {
+			respondWithError(w, 409, "This identity is already linked to another account")
+			return
+		}
+
+		respondWithJSON(w, 200, toUserIdentity(identity))
+		return
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error retrieving identity: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	identity, err = cfg.DB.CreateUserIdentity(r.Context(), database.CreateUserIdentityParams{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	})
+
+	if err != nil {
+		log.Printf("Error linking identity: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	respondWithJSON(w, 201, toUserIdentity(identity))
+}
+
+func (cfg *apiConfig) listIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	afterCreatedAt, afterID := cursorArgs(page.After)
+
+	identities, err := cfg.DB.ListUserIdentitiesByUserId(r.Context(), database.ListUserIdentitiesByUserIdParams{
+		UserID:         caller.UserID,
+		AfterCreatedAt: afterCreatedAt,
+		AfterID:        afterID,
+		PageSize:       int32(page.Limit + 1),
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving identities from database")
+		return
+	}
+
+	identities, next := pagination.Cut(identities, page, func(identity database.UserIdentity) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: identity.CreatedAt, ID: identity.ID}
+	})
+
+	respBody := make([]UserIdentity, len(identities))
+
+	for i, identity := range identities {
+		respBody[i] = toUserIdentity(identity)
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
+
+// deleteIdentityHandler unlinks an identity provider. The last one can only
+// go once the user has a password, or they couldn't log in anymore.
+func (cfg *apiConfig) deleteIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	identityID, err := uuid.Parse(r.PathValue("identityID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid identityID")
+		return
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), caller.UserID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving user from database")
+		return
+	}
+
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
+
+	if err != nil {
+		respondWithError(w, 500, "Error unlinking identity")
+		return
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	n, err := qtx.DeleteUserIdentity(r.Context(), database.DeleteUserIdentityParams{
+		ID:     identityID,
+		UserID: caller.UserID,
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error unlinking identity")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 404, "Identity not found")
+		return
+	}
+
+	remaining, err := qtx.CountUserIdentitiesByUserId(r.Context(), caller.UserID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error unlinking identity")
+		return
+	}
+
+	if user.HashedPassword == auth.UnusablePasswordHash && remaining == 0 {
+		respondWithError(w, 409, "Set a password before unlinking your last identity provider")
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		respondWithError(w, 500, "Error unlinking identity")
+		return
+	}
+
+	w.WriteHeader(204)
+}
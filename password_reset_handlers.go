@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/mailer"
+)
+
+// requestPasswordResetHandler mails a single-use reset token to the given address.
+// It always answers 204, whether or not the email belongs to an account,
+// so it cannot be used to find out who is registered.
+func (cfg *apiConfig) requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	user, err := cfg.DB.GetUserByEmail(r.Context(), params.Email)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Password reset requested for unknown email")
+		w.WriteHeader(204)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving user from database: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	resetToken, err := auth.MakePasswordResetToken()
+
+	if err != nil {
+		log.Printf("Error creating password reset token: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	_, err = cfg.DB.CreatePasswordResetToken(r.Context(), database.CreatePasswordResetTokenParams{
+		TokenHash: auth.HashToken(resetToken),
+		UserID:    user.ID,
+	})
+
+	if err != nil {
+		log.Printf("Error storing password reset token: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	err = cfg.mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password of your Chirpy account.\n\n"+
+				"Use this token with POST /api/password-reset/confirm within the next hour:\n\n%s\n\n"+
+				"If it wasn't you, you can ignore this message.",
+			resetToken,
+		),
+	})
+
+	if err != nil {
+		log.Printf("Error sending password reset mail: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// confirmPasswordResetHandler sets a new password using a reset token.
+// The token can only be used once, and all of the user's refresh tokens
+// are revoked so every existing session has to log in again.
+func (cfg *apiConfig) confirmPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	if params.Password == "" {
+		respondWithError(w, 400, "Password cannot be empty")
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.Password)
+
+	if err != nil {
+		respondWithError(w, 500, "Error hashing password")
+		return
+	}
+
+	tx, err := cfg.dbConn.BeginTx(r.Context(), nil)
+
+	if err != nil {
+		respondWithError(w, 500, "Error starting transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	qtx := cfg.DB.WithTx(tx)
+
+	resetToken, err := qtx.GetPasswordResetTokenForUpdate(r.Context(), auth.HashToken(params.Token))
+
+	if err != nil {
+		respondWithError(w, 401, "Invalid password reset token")
+		return
+	}
+
+	if resetToken.UsedAt.Valid {
+		respondWithError(w, 401, "Password reset token has already been used")
+		return
+	}
+
+	if time.Now().After(resetToken.ExpiresAt) {
+		respondWithError(w, 401, "Password reset token expired")
+		return
+	}
+
+	err = qtx.UpdateUserPasswordById(r.Context(), database.UpdateUserPasswordByIdParams{
+		ID:             resetToken.UserID,
+		HashedPassword: hashedPassword,
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating user in database")
+		return
+	}
+
+	// This token and any other outstanding for the user
+	err = qtx.MarkPasswordResetTokensUsedByUserId(r.Context(), resetToken.UserID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error updating password reset tokens")
+		return
+	}
+
+	err = qtx.RevokeRefreshTokensByUserId(r.Context(), resetToken.UserID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error revoking refresh tokens")
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		respondWithError(w, 500, "Error committing password reset")
+		return
+	}
+
+	w.WriteHeader(204)
+}
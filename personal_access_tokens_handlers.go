@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
+	"github.com/google/uuid"
+)
+
+type PersonalAccessToken struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Only set in the response to the creation request
+	Token string `json:"token,omitempty"`
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	return &t.Time
+}
+
+func toPersonalAccessToken(pat database.PersonalAccessToken) PersonalAccessToken {
+	return PersonalAccessToken{
+		ID:         pat.ID,
+		CreatedAt:  pat.CreatedAt,
+		Name:       pat.Name,
+		Scopes:     pat.Scopes,
+		ExpiresAt:  nullTimePtr(pat.ExpiresAt),
+		LastUsedAt: nullTimePtr(pat.LastUsedAt),
+	}
+}
+
+// createPersonalAccessTokenHandler creates a named token with the given scopes.
+// The token is only stored hashed, so the response is the only time it is shown.
+func (cfg *apiConfig) createPersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Error decoding parameters")
+		return
+	}
+
+	if params.Name == "" {
+		respondWithError(w, 400, "Name is required")
+		return
+	}
+
+	scopes, err := auth.ValidateScopes(params.Scopes)
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	if params.ExpiresInDays < 0 {
+		respondWithError(w, 400, "expires_in_days cannot be negative")
+		return
+	}
+
+	// Zero means the token never expires
+	expiresAt := sql.NullTime{}
+	if params.ExpiresInDays > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, params.ExpiresInDays), Valid: true}
+	}
+
+	token, err := auth.MakePersonalAccessToken()
+
+	if err != nil {
+		respondWithError(w, 500, "Error creating personal access token")
+		return
+	}
+
+	pat, err := cfg.DB.CreatePersonalAccessToken(r.Context(), database.CreatePersonalAccessTokenParams{
+		UserID:    caller.UserID,
+		Name:      params.Name,
+		TokenHash: auth.HashToken(token),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error storing personal access token")
+		return
+	}
+
+	respBody := toPersonalAccessToken(pat)
+	respBody.Token = token
+
+	respondWithJSON(w, 201, respBody)
+}
+
+func (cfg *apiConfig) listPersonalAccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	beforeCreatedAt, beforeID := cursorArgs(page.After)
+
+	pats, err := cfg.DB.ListPersonalAccessTokensByUserId(r.Context(), database.ListPersonalAccessTokensByUserIdParams{
+		UserID:          caller.UserID,
+		BeforeCreatedAt: beforeCreatedAt,
+		BeforeID:        beforeID,
+		PageSize:        int32(page.Limit + 1),
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving personal access tokens from database")
+		return
+	}
+
+	pats, next := pagination.Cut(pats, page, func(pat database.PersonalAccessToken) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: pat.CreatedAt, ID: pat.ID}
+	})
+
+	respBody := make([]PersonalAccessToken, len(pats))
+
+	for i, pat := range pats {
+		respBody[i] = toPersonalAccessToken(pat)
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
+
+func (cfg *apiConfig) revokePersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := uuid.Parse(r.PathValue("tokenID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid tokenID")
+		return
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	n, err := cfg.DB.RevokePersonalAccessToken(r.Context(), database.RevokePersonalAccessTokenParams{
+		ID:     tokenID,
+		UserID: caller.UserID,
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error revoking personal access token")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 404, "Personal access token not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
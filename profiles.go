@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Profile is the public view of a user. Unlike User, it never contains the email.
+type Profile struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatar_url"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+}
+
+// Author is the compact profile embedded in chirps.
+type Author struct {
+	ID          uuid.UUID `json:"id"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url"`
+}
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
+
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,30}$`)
+
+// Handles that would read like part of the API in /api/users/{idOrHandle}
+var reservedHandles = []string{"admin", "api", "me", "restore", "verify"}
+
+func validHandle(handle string) bool {
+	return handlePattern.MatchString(handle) && !slices.Contains(reservedHandles, strings.ToLower(handle))
+}
+
+// validAvatarURL accepts an https URL, or an empty string to remove the avatar.
+func validAvatarURL(avatarURL string) bool {
+	if avatarURL == "" {
+		return true
+	}
+
+	if len(avatarURL) > maxAvatarURLLength {
+		return false
+	}
+
+	u, err := url.Parse(avatarURL)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// defaultHandle is given to users who didn't choose one, like those signing
+// up through an identity provider. They can change it later.
+func defaultHandle() string {
+	return "user_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+}
+
+func isHandleTaken(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "users_handle_key"
+}
+
+func toProfile(user database.User) Profile {
+	return Profile{
+		ID:          user.ID,
+		CreatedAt:   user.CreatedAt,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarUrl,
+		IsChirpyRed: user.IsChirpyRed.Valid && user.IsChirpyRed.Bool,
+	}
+}
+
+// profileUpdate holds the profile fields of a PATCH /api/users request,
+// nil fields are left unchanged.
+type profileUpdate struct {
+	Handle      *string `json:"handle"`
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	AvatarURL   *string `json:"avatar_url"`
+}
+
+func (p profileUpdate) isEmpty() bool {
+	return p.Handle == nil && p.DisplayName == nil && p.Bio == nil && p.AvatarURL == nil
+}
+
+// validate returns a message for the client if a field is invalid.
+func (p profileUpdate) validate() string {
+	if p.Handle != nil && !validHandle(*p.Handle) {
+		return "Handle must be 3 to 30 letters, digits or underscores"
+	}
+
+	if p.DisplayName != nil && utf8.RuneCountInString(*p.DisplayName) > maxDisplayNameLength {
+		return "Display name is too long"
+	}
+
+	if p.Bio != nil && utf8.RuneCountInString(*p.Bio) > maxBioLength {
+		return "Bio is too long"
+	}
+
+	if p.AvatarURL != nil && !validAvatarURL(*p.AvatarURL) {
+		return "Avatar URL must be an https URL"
+	}
+
+	return ""
+}
+
+func (p profileUpdate) apply(user database.User) database.UpdateUserProfileParams {
+	params := database.UpdateUserProfileParams{
+		ID:          user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarUrl:   user.AvatarUrl,
+	}
+
+	if p.Handle != nil {
+		params.Handle = *p.Handle
+	}
+
+	if p.DisplayName != nil {
+		params.DisplayName = strings.TrimSpace(*p.DisplayName)
+	}
+
+	if p.Bio != nil {
+		params.Bio = strings.TrimSpace(*p.Bio)
+	}
+
+	if p.AvatarURL != nil {
+		params.AvatarUrl = *p.AvatarURL
+	}
+
+	return params
+}
+
+// lookupUser finds a user by ID or handle. Accounts scheduled for deletion
+// are hidden like purged ones, with sql.ErrNoRows.
+func (cfg *apiConfig) lookupUser(ctx context.Context, idOrHandle string) (database.User, error) {
+	var user database.User
+	userID, err := uuid.Parse(idOrHandle)
+
+	if err == nil {
+		user, err = cfg.DB.GetUserById(ctx, userID)
+	} else {
+		user, err = cfg.DB.GetUserByHandle(ctx, idOrHandle)
+	}
+
+	if err != nil {
+		return database.User{}, err
+	}
+
+	if user.DeletedAt.Valid {
+		return database.User{}, sql.ErrNoRows
+	}
+
+	return user, nil
+}
+
+// getUserProfileHandler shows a user's public profile, looked up by ID or handle.
+func (cfg *apiConfig) getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.lookupUser(r.Context(), r.PathValue("idOrHandle"))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving user from database: %s", err)
+		respondWithError(w, 500, "Error retrieving user from database")
+		return
+	}
+
+	respondWithJSON(w, 200, toProfile(user))
+}
+
+// wantsEmbed reports whether the request asks for the related object with
+// ?embed=name. Several can be given separated by commas.
+func wantsEmbed(r *http.Request, name string) bool {
+	for _, embed := range strings.Split(r.URL.Query().Get("embed"), ",") {
+		if strings.TrimSpace(embed) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// embedAuthors adds the author's compact profile to each chirp, with one
+// query for all of them. Chirps of accounts that are purged or scheduled for
+// deletion stay without an author, like lookupUser hides their profiles.
+func (cfg *apiConfig) embedAuthors(ctx context.Context, chirps []Chirp) error {
+	userIDs := []uuid.UUID{}
+	seen := map[uuid.UUID]bool{}
+
+	for _, chirp := range chirps {
+		if chirp.UserID != nil && !seen[*chirp.UserID] {
+			seen[*chirp.UserID] = true
+			userIDs = append(userIDs, *chirp.UserID)
+		}
+	}
+
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	profiles, err := cfg.DB.GetUserProfilesByIds(ctx, userIDs)
+
+	if err != nil {
+		return err
+	}
+
+	authors := make(map[uuid.UUID]*Author, len(profiles))
+
+	for _, profile := range profiles {
+		authors[profile.ID] = &Author{
+			ID:          profile.ID,
+			Handle:      profile.Handle,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarUrl,
+		}
+	}
+
+	for i, chirp := range chirps {
+		if chirp.UserID != nil {
+			chirps[i].Author = authors[*chirp.UserID]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/auth"
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// getOriginalChirp fetches a chirp to reply to, quote, rechirp or like. A
+// rechirp stands for the chirp it shares, so that one is returned instead.
+// Rechirps are always of originals, so there is at most one hop.
+func (cfg *apiConfig) getOriginalChirp(ctx context.Context, chirpID uuid.UUID) (database.GetChirpRow, error) {
+	chirp, err := cfg.DB.GetChirp(ctx, chirpID)
+
+	if err != nil || !chirp.RechirpOfID.Valid {
+		return chirp, err
+	}
+
+	return cfg.DB.GetChirp(ctx, chirp.RechirpOfID.UUID)
+}
+
+// embedOriginals adds the chirps shared by rechirps and quoted by quotes,
+// with one query for all of them. It returns the embedded chirps.
+func (cfg *apiConfig) embedOriginals(ctx context.Context, chirps []Chirp) ([]Chirp, error) {
+	chirpIDs := []uuid.UUID{}
+	seen := map[uuid.UUID]bool{}
+
+	for _, chirp := range chirps {
+		for _, id := range []*uuid.UUID{chirp.RechirpOfID, chirp.QuoteOfID} {
+			if id != nil && !seen[*id] {
+				seen[*id] = true
+				chirpIDs = append(chirpIDs, *id)
+			}
+		}
+	}
+
+	if len(chirpIDs) == 0 {
+		return nil, nil
+	}
+
+	rows, err := cfg.DB.GetChirpsByIds(ctx, chirpIDs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	originals := make([]Chirp, len(rows))
+	byID := make(map[uuid.UUID]*Chirp, len(rows))
+
+	for i, row := range rows {
+		originals[i] = toChirp(row)
+		byID[row.ID] = &originals[i]
+	}
+
+	for i, chirp := range chirps {
+		if chirp.RechirpOfID != nil {
+			chirps[i].RechirpOf = byID[*chirp.RechirpOfID]
+		}
+
+		if chirp.QuoteOfID != nil {
+			chirps[i].Quoted = byID[*chirp.QuoteOfID]
+		}
+	}
+
+	return originals, nil
+}
+
+// rechirpHandler shares a chirp on the caller's behalf. The rechirp is a
+// chirp of the caller without a body, pointing at the original.
+func (cfg *apiConfig) rechirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirpID")
+		return
+	}
+
+	caller, ok := requireScope(w, r, auth.ScopeChirpsWrite)
+
+	if !ok {
+		return
+	}
+
+	user, err := cfg.DB.GetUserById(r.Context(), caller.UserID)
+
+	if err != nil {
+		log.Printf("Error retrieving user from database: %s", err)
+		w.WriteHeader(401)
+		return
+	}
+
+	if !cfg.unverifiedPolicy.canPostChirps(user) {
+		respondWithError(w, 403, "Verify your email address before posting chirps")
+		return
+	}
+
+	original, err := cfg.getOriginalChirp(r.Context(), chirpID)
+
+	if errors.Is(err, sql.ErrNoRows) || err == nil && original.DeletedAt.Valid {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving chirp from database: %s", err)
+		respondWithError(w, 500, "Error rechirping chirp")
+		return
+	}
+
+	rechirp, err := cfg.DB.CreateChirp(r.Context(), database.CreateChirpParams{
+		UserID:      uuid.NullUUID{UUID: caller.UserID, Valid: true},
+		RechirpOfID: uuid.NullUUID{UUID: original.ID, Valid: true},
+	})
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "chirps_user_id_rechirp_of_id_key" {
+		respondWithError(w, 409, "You already rechirped this chirp")
+		return
+	}
+
+	// The original was deleted in the meantime
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error creating rechirp: %s", err)
+		respondWithError(w, 500, "Error rechirping chirp")
+		return
+	}
+
+	respBody := []Chirp{toChirp(rechirp)}
+	err = cfg.prepareChirps(r, respBody)
+
+	if err != nil {
+		log.Printf("Error preparing chirp: %s", err)
+		respondWithError(w, 500, "Error rechirping chirp")
+		return
+	}
+
+	respondWithJSON(w, 201, respBody[0])
+}
+
+// unrechirpHandler takes back the caller's rechirp of a chirp. Deleting the
+// rechirp itself with DELETE /api/chirps/{chirpID} works too.
+func (cfg *apiConfig) unrechirpHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirpID")
+		return
+	}
+
+	caller, ok := requireScope(w, r, auth.ScopeChirpsDelete)
+
+	if !ok {
+		return
+	}
+
+	original, err := cfg.getOriginalChirp(r.Context(), chirpID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving chirp from database: %s", err)
+		respondWithError(w, 500, "Error removing rechirp")
+		return
+	}
+
+	n, err := cfg.DB.DeleteRechirp(r.Context(), database.DeleteRechirpParams{
+		UserID:      uuid.NullUUID{UUID: caller.UserID, Valid: true},
+		RechirpOfID: uuid.NullUUID{UUID: original.ID, Valid: true},
+	})
+
+	if err != nil {
+		log.Printf("Error deleting rechirp: %s", err)
+		respondWithError(w, 500, "Error removing rechirp")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 404, "You haven't rechirped this chirp")
+		return
+	}
+
+	w.WriteHeader(204)
+}
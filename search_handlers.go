@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
+	"github.com/ValentinoFilipetto/chirpy/internal/search"
+	"github.com/google/uuid"
+)
+
+// SearchResult is a chirp that matched a search, with the matching parts
+// highlighted in an HTML snippet.
+type SearchResult struct {
+	Chirp
+	Snippet string `json:"snippet"`
+}
+
+// searchChirpsHandler finds chirps matching ?q=, best and newest matches
+// first. See search.ParseQuery for the query syntax.
+func (cfg *apiConfig) searchChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+
+	if len(q) > search.MaxQueryLength {
+		respondWithError(w, 400, "Search query is too long")
+		return
+	}
+
+	tsquery, err := search.ParseQuery(q)
+
+	if err != nil {
+		respondWithError(w, 400, "Search query must contain at least one word")
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	params := database.SearchChirpsParams{
+		Query:    tsquery,
+		PageSize: int32(page.Limit + 1),
+	}
+
+	if page.After != nil {
+		params.BeforeScore = sql.NullFloat64{Float64: page.After.Score, Valid: true}
+		params.BeforeID = uuid.NullUUID{UUID: page.After.ID, Valid: true}
+	}
+
+	rows, err := cfg.DB.SearchChirps(r.Context(), params)
+
+	if err != nil {
+		log.Printf("Error searching chirps: %s", err)
+		respondWithError(w, 500, "Error searching chirps")
+		return
+	}
+
+	rows, next := pagination.Cut(rows, page, func(row database.SearchChirpsRow) pagination.Cursor {
+		return pagination.Cursor{Score: row.Score, ID: row.ID}
+	})
+
+	chirps := make([]Chirp, len(rows))
+
+	for i, row := range rows {
+		chirps[i] = Chirp{
+			ID:             row.ID,
+			CreatedAt:      row.CreatedAt,
+			UpdatedAt:      row.UpdatedAt,
+			Body:           row.Body,
+			UserID:         nullUUIDPtr(row.UserID),
+			InReplyToID:    nullUUIDPtr(row.InReplyToID),
+			ConversationID: row.ConversationID,
+			LikeCount:      row.LikeCount,
+			RechirpOfID:    nullUUIDPtr(row.RechirpOfID),
+			QuoteOfID:      nullUUIDPtr(row.QuoteOfID),
+			RechirpCount:   row.RechirpCount,
+			Edited:         row.EditCount > 0,
+			EditCount:      row.EditCount,
+		}
+	}
+
+	err = cfg.prepareChirps(r, chirps)
+
+	if err != nil {
+		log.Printf("Error preparing chirps: %s", err)
+		respondWithError(w, 500, "Error searching chirps")
+		return
+	}
+
+	respBody := struct {
+		Chirps     []SearchResult `json:"chirps"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+	}{
+		Chirps:     make([]SearchResult, len(rows)),
+		NextCursor: next,
+	}
+
+	for i, row := range rows {
+		respBody.Chirps[i] = SearchResult{
+			Chirp:   chirps[i],
+			Snippet: search.Highlight(row.Snippet),
+		}
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
+	"github.com/google/uuid"
+)
+
+// User agents are client controlled, keep what we store bounded
+const maxUserAgentLength = 512
+
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	StartedAt  time.Time `json:"started_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+}
+
+func sessionUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+
+	if len(userAgent) > maxUserAgentLength {
+		return userAgent[:maxUserAgentLength]
+	}
+
+	return userAgent
+}
+
+// A session is a refresh token family: it starts at login and lives on
+// through every rotation of its refresh token. Its ID is the family ID.
+// Sessions are listed newest first, a page at a time.
+func (cfg *apiConfig) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	beforeStartedAt, beforeID := cursorArgs(page.After)
+
+	sessions, err := cfg.DB.ListActiveSessionsByUserId(r.Context(), database.ListActiveSessionsByUserIdParams{
+		UserID:          caller.UserID,
+		BeforeStartedAt: beforeStartedAt,
+		BeforeID:        beforeID,
+		PageSize:        int32(page.Limit + 1),
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error retrieving sessions from database")
+		return
+	}
+
+	sessions, next := pagination.Cut(sessions, page, func(session database.ListActiveSessionsByUserIdRow) pagination.Cursor {
+		return pagination.Cursor{CreatedAt: session.StartedAt, ID: session.FamilyID}
+	})
+
+	respBody := make([]Session, len(sessions))
+
+	for i, session := range sessions {
+		respBody[i] = Session{
+			ID:         session.FamilyID,
+			StartedAt:  session.StartedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IpAddress,
+		}
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
+
+func (cfg *apiConfig) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid sessionID")
+		return
+	}
+
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	n, err := cfg.DB.RevokeUserSession(r.Context(), database.RevokeUserSessionParams{
+		FamilyID: sessionID,
+		UserID:   caller.UserID,
+	})
+
+	if err != nil {
+		respondWithError(w, 500, "Error revoking session")
+		return
+	}
+
+	if n == 0 {
+		respondWithError(w, 404, "Session not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// revokeAllSessionsHandler logs the user out everywhere. Access tokens that
+// were already issued stay valid until they expire.
+func (cfg *apiConfig) revokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireLogin(w, r)
+
+	if !ok {
+		return
+	}
+
+	err := cfg.DB.RevokeRefreshTokensByUserId(r.Context(), caller.UserID)
+
+	if err != nil {
+		respondWithError(w, 500, "Error revoking sessions")
+		return
+	}
+
+	w.WriteHeader(204)
+}
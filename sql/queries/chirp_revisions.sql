@@ -0,0 +1,12 @@
+-- name: CreateChirpRevision :exec
+INSERT INTO chirp_revisions (id, chirp_id, body, created_at, replaced_at)
+VALUES (gen_random_uuid(), $1, $2, $3, NOW());
+
+-- name: ListChirpRevisions :many
+-- Newest first, the revision replaced by the current body comes first.
+SELECT * FROM chirp_revisions
+WHERE chirp_id = sqlc.arg(chirp_id)
+AND (sqlc.narg(before_replaced_at)::TIMESTAMP IS NULL
+    OR (replaced_at, id) < (sqlc.narg(before_replaced_at)::TIMESTAMP, sqlc.narg(before_id)::UUID))
+ORDER BY replaced_at DESC, id DESC
+LIMIT sqlc.arg(page_size);
@@ -1,30 +1,168 @@
+-- Chirp queries name their columns rather than SELECT *, so rows don't carry
+-- search_vector, which only SearchChirps needs.
+
 -- name: CreateChirp :one
-INSERT INTO chirps (id, created_at, updated_at, body, user_id)
-VALUES (
-    gen_random_uuid(),
+-- A reply joins the conversation of the chirp it answers, any other chirp
+-- starts its own.
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, rechirp_of_id, quote_of_id)
+SELECT
+    new_chirp.id,
     NOW(),
     NOW(),
     $1,
-    $2
-)
-RETURNING *;
+    $2,
+    sqlc.narg(in_reply_to_id)::UUID,
+    COALESCE((SELECT conversation_id FROM chirps WHERE chirps.id = sqlc.narg(in_reply_to_id)::UUID), new_chirp.id),
+    sqlc.narg(rechirp_of_id)::UUID,
+    sqlc.narg(quote_of_id)::UUID
+FROM (SELECT gen_random_uuid() AS id) new_chirp
+RETURNING id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count;
 
 -- name: DeleteChirps :exec
 DELETE FROM chirps;
 
--- name: GetAllChirps :many
-SELECT * FROM chirps
-ORDER BY created_at ASC;
-
 -- name: GetChirp :one
-SELECT * FROM chirps
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
 WHERE id = $1;
 
--- name: DeleteChirpById :exec
+-- name: GetChirpForUpdate :one
+-- Locks the chirp until the end of the transaction, so edits don't race.
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE id = $1
+FOR UPDATE;
+
+-- name: GetChirpsByIds :many
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE id = ANY(sqlc.arg(ids)::UUID[]);
+
+-- name: DeleteRechirp :execrows
 DELETE FROM chirps
-WHERE id = $1;
+WHERE user_id = $1 AND rechirp_of_id = $2;
+
+-- name: DeleteRechirpsByUserId :exec
+DELETE FROM chirps
+WHERE user_id = $1 AND rechirp_of_id IS NOT NULL;
+
+-- name: DeleteUnreferencedTombstone :one
+-- Deletes a tombstone once nothing replies to or quotes it anymore. Returns
+-- what it replied to or quoted, which may be such a tombstone in turn.
+DELETE FROM chirps
+WHERE id = $1 AND deleted_at IS NOT NULL
+AND NOT EXISTS (SELECT 1 FROM chirps other WHERE other.in_reply_to_id = chirps.id OR other.quote_of_id = chirps.id)
+RETURNING in_reply_to_id, quote_of_id;
+
+-- name: DeleteChirpById :execrows
+-- Chirps with replies or quotes are not deleted, see TombstoneChirp.
+DELETE FROM chirps
+WHERE id = $1
+AND NOT EXISTS (SELECT 1 FROM chirps other WHERE other.in_reply_to_id = chirps.id OR other.quote_of_id = chirps.id);
 
--- name: GetChirpsByUserId :many
-SELECT * FROM chirps
+-- name: UpdateChirpBody :one
+UPDATE chirps
+SET body = $2, updated_at = NOW(), edit_count = edit_count + 1
+WHERE id = $1
+RETURNING id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count;
+
+-- name: TombstoneChirp :execrows
+UPDATE chirps
+SET body = '', deleted_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: DeleteChirpsByUserId :many
+-- Chirps with replies or quotes are not deleted, see TombstoneChirpsByUserId.
+-- Returns what the deleted chirps replied to or quoted, see
+-- DeleteUnreferencedTombstone.
+DELETE FROM chirps
 WHERE user_id = $1
-ORDER BY created_at ASC;
\ No newline at end of file
+AND NOT EXISTS (SELECT 1 FROM chirps other WHERE other.in_reply_to_id = chirps.id OR other.quote_of_id = chirps.id)
+RETURNING in_reply_to_id, quote_of_id;
+
+-- name: TombstoneChirpsByUserId :exec
+UPDATE chirps
+SET body = '', deleted_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND deleted_at IS NULL
+AND EXISTS (SELECT 1 FROM chirps other WHERE other.in_reply_to_id = chirps.id OR other.quote_of_id = chirps.id);
+
+-- name: ListChirps :many
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE deleted_at IS NULL
+AND (sqlc.narg(author_id)::UUID IS NULL OR user_id = sqlc.narg(author_id)::UUID)
+-- Rechirps only show up on their author's list, elsewhere they'd repeat the original
+AND (sqlc.narg(author_id)::UUID IS NOT NULL OR rechirp_of_id IS NULL)
+AND (sqlc.narg(after_created_at)::TIMESTAMP IS NULL
+    OR (created_at, id) > (sqlc.narg(after_created_at)::TIMESTAMP, sqlc.narg(after_id)::UUID))
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg(page_size);
+
+-- name: ListChirpsDesc :many
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE deleted_at IS NULL
+AND (sqlc.narg(author_id)::UUID IS NULL OR user_id = sqlc.narg(author_id)::UUID)
+-- Rechirps only show up on their author's list, elsewhere they'd repeat the original
+AND (sqlc.narg(author_id)::UUID IS NOT NULL OR rechirp_of_id IS NULL)
+AND (sqlc.narg(before_created_at)::TIMESTAMP IS NULL
+    OR (created_at, id) < (sqlc.narg(before_created_at)::TIMESTAMP, sqlc.narg(before_id)::UUID))
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: SearchChirps :many
+-- Relevance is combined with recency: a perfect match ranks like a weak one
+-- about 30 days newer. The score doesn't depend on the current time, so
+-- cursors over it stay valid.
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count,
+    ts_headline('english', body, query,
+        'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', MaxFragments=2, MinWords=5, MaxWords=20')::TEXT AS snippet,
+    score
+FROM (
+    SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count, query,
+        ts_rank_cd(search_vector, query, 32)::FLOAT8 + EXTRACT(EPOCH FROM created_at)::FLOAT8 / 2592000 AS score
+    FROM chirps, to_tsquery('english', sqlc.arg(query)) query
+    WHERE search_vector @@ query
+) ranked
+WHERE sqlc.narg(before_score)::FLOAT8 IS NULL
+    OR (score, id) < (sqlc.narg(before_score)::FLOAT8, sqlc.narg(before_id)::UUID)
+ORDER BY score DESC, id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: GetChirpAncestors :many
+-- The chirps the given chirp replies to, directly or not, root first.
+WITH RECURSIVE ancestors AS (
+    SELECT parent.id, parent.in_reply_to_id, 1 AS distance
+    FROM chirps parent
+    JOIN chirps child ON child.in_reply_to_id = parent.id
+    WHERE child.id = $1
+    UNION ALL
+    SELECT chirps.id, chirps.in_reply_to_id, ancestors.distance + 1
+    FROM chirps
+    JOIN ancestors ON chirps.id = ancestors.in_reply_to_id
+)
+SELECT chirps.id, chirps.created_at, chirps.updated_at, chirps.body, chirps.user_id, chirps.in_reply_to_id, chirps.conversation_id, chirps.deleted_at, chirps.like_count, chirps.rechirp_of_id, chirps.quote_of_id, chirps.rechirp_count, chirps.edit_count FROM chirps
+JOIN ancestors ON chirps.id = ancestors.id
+ORDER BY ancestors.distance DESC;
+
+-- name: ListConversationReplies :many
+-- Every reply in the thread started by the root chirp, oldest first. A reply
+-- is always newer than the chirp it answers, so parents come before their
+-- replies, across pages too.
+SELECT id, created_at, updated_at, body, user_id, in_reply_to_id, conversation_id, deleted_at, like_count, rechirp_of_id, quote_of_id, rechirp_count, edit_count FROM chirps
+WHERE conversation_id = sqlc.arg(root_id) AND id <> sqlc.arg(root_id)
+AND (sqlc.narg(after_created_at)::TIMESTAMP IS NULL
+    OR (created_at, id) > (sqlc.narg(after_created_at)::TIMESTAMP, sqlc.narg(after_id)::UUID))
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg(page_size);
+
+-- name: ListDescendantReplies :many
+-- Like ListConversationReplies, for a chirp in the middle of a thread.
+WITH RECURSIVE descendants AS (
+    SELECT chirps.id FROM chirps
+    WHERE chirps.in_reply_to_id = sqlc.arg(chirp_id)
+    UNION ALL
+    SELECT chirps.id FROM chirps
+    JOIN descendants ON chirps.in_reply_to_id = descendants.id
+)
+SELECT chirps.id, chirps.created_at, chirps.updated_at, chirps.body, chirps.user_id, chirps.in_reply_to_id, chirps.conversation_id, chirps.deleted_at, chirps.like_count, chirps.rechirp_of_id, chirps.quote_of_id, chirps.rechirp_count, chirps.edit_count FROM chirps
+JOIN descendants ON chirps.id = descendants.id
+WHERE sqlc.narg(after_created_at)::TIMESTAMP IS NULL
+    OR (chirps.created_at, chirps.id) > (sqlc.narg(after_created_at)::TIMESTAMP, sqlc.narg(after_id)::UUID)
+ORDER BY chirps.created_at ASC, chirps.id ASC
+LIMIT sqlc.arg(page_size);
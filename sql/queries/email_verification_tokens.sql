@@ -0,0 +1,21 @@
+-- name: CreateEmailVerificationToken :one
+INSERT INTO email_verification_tokens (token_hash, created_at, user_id, email, expires_at, used_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    $3,
+    NOW() + INTERVAL '24 hours',
+    null
+)
+RETURNING *;
+
+-- name: GetEmailVerificationTokenForUpdate :one
+SELECT * FROM email_verification_tokens
+WHERE token_hash = $1
+FOR UPDATE;
+
+-- name: MarkEmailVerificationTokenUsed :exec
+UPDATE email_verification_tokens
+SET used_at = NOW()
+WHERE token_hash = $1;
@@ -0,0 +1,50 @@
+-- name: FollowUser :exec
+INSERT INTO follows (follower_id, followee_id, created_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT DO NOTHING;
+
+-- name: UnfollowUser :exec
+DELETE FROM follows
+WHERE follower_id = $1 AND followee_id = $2;
+
+-- name: ListFollowers :many
+SELECT users.id, users.handle, users.display_name, users.avatar_url, follows.created_at AS followed_at
+FROM follows
+JOIN users ON users.id = follows.follower_id
+WHERE follows.followee_id = sqlc.arg(user_id)
+AND users.deleted_at IS NULL
+AND (sqlc.narg(before_followed_at)::TIMESTAMP IS NULL
+    OR (follows.created_at, follows.follower_id) < (sqlc.narg(before_followed_at)::TIMESTAMP, sqlc.narg(before_id)::UUID))
+ORDER BY follows.created_at DESC, follows.follower_id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: ListFollowing :many
+SELECT users.id, users.handle, users.display_name, users.avatar_url, follows.created_at AS followed_at
+FROM follows
+JOIN users ON users.id = follows.followee_id
+WHERE follows.follower_id = sqlc.arg(user_id)
+AND users.deleted_at IS NULL
+AND (sqlc.narg(before_followed_at)::TIMESTAMP IS NULL
+    OR (follows.created_at, follows.followee_id) < (sqlc.narg(before_followed_at)::TIMESTAMP, sqlc.narg(before_id)::UUID))
+ORDER BY follows.created_at DESC, follows.followee_id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: GetTimeline :many
+-- Each followed account contributes at most a page of its newest chirps,
+-- read from chirps_user_id_created_at_idx, and only those are merged. The
+-- cost grows with the number of accounts followed, not with their chirps.
+SELECT recent.id, recent.created_at, recent.updated_at, recent.body, recent.user_id, recent.in_reply_to_id, recent.conversation_id, recent.deleted_at, recent.like_count, recent.rechirp_of_id, recent.quote_of_id, recent.rechirp_count, recent.edit_count FROM follows
+JOIN users ON users.id = follows.followee_id
+CROSS JOIN LATERAL (
+    SELECT chirps.id, chirps.created_at, chirps.updated_at, chirps.body, chirps.user_id, chirps.in_reply_to_id, chirps.conversation_id, chirps.deleted_at, chirps.like_count, chirps.rechirp_of_id, chirps.quote_of_id, chirps.rechirp_count, chirps.edit_count FROM chirps
+    WHERE chirps.user_id = follows.followee_id
+    AND chirps.deleted_at IS NULL
+    AND (sqlc.narg(before_created_at)::TIMESTAMP IS NULL
+        OR (chirps.created_at, chirps.id) < (sqlc.narg(before_created_at)::TIMESTAMP, sqlc.narg(before_id)::UUID))
+    ORDER BY chirps.created_at DESC, chirps.id DESC
+    LIMIT sqlc.arg(page_size)
+) recent
+WHERE follows.follower_id = sqlc.arg(user_id)
+AND users.deleted_at IS NULL
+ORDER BY recent.created_at DESC, recent.id DESC
+LIMIT sqlc.arg(page_size);
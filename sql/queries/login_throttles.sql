@@ -0,0 +1,29 @@
+-- name: RecordFailedLogin :one
+INSERT INTO login_throttles (key, failed_attempts, last_failed_at, locked_until)
+VALUES (
+    $1,
+    1,
+    NOW(),
+    null
+)
+ON CONFLICT (key) DO UPDATE
+SET failed_attempts = CASE
+        WHEN login_throttles.last_failed_at < NOW() - INTERVAL '1 hour' THEN 1
+        ELSE login_throttles.failed_attempts + 1
+    END,
+    last_failed_at = NOW()
+RETURNING *;
+
+-- name: LockLogin :exec
+UPDATE login_throttles
+SET locked_until = NOW() + (sqlc.arg(lock_seconds)::INTEGER * INTERVAL '1 second')
+WHERE key = sqlc.arg(key);
+
+-- name: GetLoginLockSeconds :one
+SELECT COALESCE(CEIL(EXTRACT(EPOCH FROM MAX(locked_until) - NOW())), 0)::INTEGER AS seconds
+FROM login_throttles
+WHERE key = ANY(sqlc.arg(keys)::TEXT[]) AND locked_until > NOW();
+
+-- name: ClearLoginThrottle :exec
+DELETE FROM login_throttles
+WHERE key = $1;
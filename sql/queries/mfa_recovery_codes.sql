@@ -0,0 +1,17 @@
+-- name: CreateRecoveryCode :exec
+INSERT INTO mfa_recovery_codes (code_hash, created_at, user_id, used_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    null
+);
+
+-- name: DeleteRecoveryCodesByUserId :exec
+DELETE FROM mfa_recovery_codes
+WHERE user_id = $1;
+
+-- name: UseRecoveryCode :execrows
+UPDATE mfa_recovery_codes
+SET used_at = NOW()
+WHERE code_hash = $1 AND user_id = $2 AND used_at IS NULL;
@@ -0,0 +1,24 @@
+-- name: CreateOAuthAuthorizationCode :exec
+INSERT INTO oauth_authorization_codes (code_hash, created_at, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at, used_at, family_id)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    NOW() + INTERVAL '5 minutes',
+    null,
+    null
+);
+
+-- name: GetOAuthAuthorizationCodeForUpdate :one
+SELECT * FROM oauth_authorization_codes
+WHERE code_hash = $1
+FOR UPDATE;
+
+-- name: MarkOAuthAuthorizationCodeUsed :exec
+UPDATE oauth_authorization_codes
+SET used_at = NOW(), family_id = $2
+WHERE code_hash = $1;
@@ -0,0 +1,28 @@
+-- name: CreateOAuthClient :one
+INSERT INTO oauth_clients (id, created_at, user_id, name, secret_hash, redirect_uris, scopes)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5
+)
+RETURNING *;
+
+-- name: DeleteOAuthClient :execrows
+DELETE FROM oauth_clients
+WHERE id = $1 AND user_id = $2;
+
+-- name: GetOAuthClient :one
+SELECT * FROM oauth_clients
+WHERE id = $1;
+
+-- name: ListOAuthClientsByUserId :many
+SELECT * FROM oauth_clients
+WHERE user_id = sqlc.arg(user_id)
+AND (sqlc.narg(before_created_at)::TIMESTAMP IS NULL
+    OR (created_at, id) < (sqlc.narg(before_created_at)::TIMESTAMP, sqlc.narg(before_id)::UUID))
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(page_size);
@@ -0,0 +1,17 @@
+-- name: ConsumeOIDCLoginState :one
+DELETE FROM oidc_login_states
+WHERE state_hash = $1
+RETURNING *;
+
+-- name: CreateOIDCLoginState :exec
+INSERT INTO oidc_login_states (state_hash, created_at, provider, nonce, code_verifier, user_id, use_cookies, expires_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    NOW() + INTERVAL '10 minutes'
+);
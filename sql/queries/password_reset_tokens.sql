@@ -0,0 +1,21 @@
+-- name: CreatePasswordResetToken :one
+INSERT INTO password_reset_tokens (token_hash, created_at, user_id, expires_at, used_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    NOW() + INTERVAL '1 hour',
+    null
+)
+RETURNING *;
+
+-- name: GetPasswordResetTokenForUpdate :one
+SELECT * FROM password_reset_tokens
+WHERE token_hash = $1
+FOR UPDATE;
+
+-- name: MarkPasswordResetTokensUsedByUserId :exec
+-- Once a reset goes through, the other links that were sent stop working too.
+UPDATE password_reset_tokens
+SET used_at = NOW()
+WHERE user_id = $1 AND used_at IS NULL;
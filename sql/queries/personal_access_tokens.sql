@@ -0,0 +1,36 @@
+-- name: CreatePersonalAccessToken :one
+INSERT INTO personal_access_tokens (id, created_at, user_id, name, token_hash, scopes, expires_at, last_used_at, revoked_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    null,
+    null
+)
+RETURNING *;
+
+-- name: GetPersonalAccessTokenByHash :one
+SELECT * FROM personal_access_tokens
+WHERE token_hash = $1;
+
+-- name: ListPersonalAccessTokensByUserId :many
+SELECT * FROM personal_access_tokens
+WHERE user_id = sqlc.arg(user_id) AND revoked_at IS NULL
+AND (sqlc.narg(before_created_at)::TIMESTAMP IS NULL
+    OR (created_at, id) < (sqlc.narg(before_created_at)::TIMESTAMP, sqlc.narg(before_id)::UUID))
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: RevokePersonalAccessToken :execrows
+UPDATE personal_access_tokens
+SET revoked_at = NOW()
+WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;
+
+-- name: TouchPersonalAccessToken :exec
+UPDATE personal_access_tokens
+SET last_used_at = NOW()
+WHERE id = $1;
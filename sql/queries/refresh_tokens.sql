@@ -1,25 +1,58 @@
 -- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, user_id, expires_at, revoked_at)
+INSERT INTO refresh_tokens (token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id, parent_token_hash, user_agent, ip_address, last_used_at, client_id, scopes)
 VALUES (
     $1,
     NOW(),
     NOW(),
     $2,
     NOW() + INTERVAL '60 days',
-    null
+    null,
+    $3,
+    $4,
+    $5,
+    $6,
+    NOW(),
+    $7,
+    $8
 )
 RETURNING *;
 
 -- name: GetRefreshToken :one
 SELECT 
-    token, 
+    token_hash, 
     created_at, 
     updated_at, 
     user_id, 
     expires_at,
-    revoked_at
+    revoked_at,
+    family_id,
+    parent_token_hash,
+    user_agent,
+    ip_address,
+    last_used_at,
+    client_id,
+    scopes
 FROM refresh_tokens 
-WHERE token = $1;
+WHERE token_hash = $1;
+
+-- name: GetRefreshTokenForUpdate :one
+SELECT 
+    token_hash, 
+    created_at, 
+    updated_at, 
+    user_id, 
+    expires_at,
+    revoked_at,
+    family_id,
+    parent_token_hash,
+    user_agent,
+    ip_address,
+    last_used_at,
+    client_id,
+    scopes
+FROM refresh_tokens 
+WHERE token_hash = $1
+FOR UPDATE;
 
 
 -- name: DeleteRefreshToken :exec
@@ -28,4 +61,70 @@ DELETE FROM refresh_tokens;
 -- name: RevokeRefreshToken :exec
 UPDATE refresh_tokens
 SET revoked_at = NOW(), updated_at = NOW()
-WHERE token = $1;
\ No newline at end of file
+WHERE token_hash = $1;
+
+-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1 AND revoked_at IS NULL;
+
+-- name: RevokeRefreshTokensByUserId :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
+
+-- name: ListActiveSessionsByUserId :many
+-- Newest sessions first. Pages go by start time, which unlike the last use
+-- doesn't change while a client pages through.
+SELECT family_id, user_agent, ip_address, last_used_at, expires_at, started_at
+FROM (
+    SELECT
+        rt.family_id,
+        rt.user_agent,
+        rt.ip_address,
+        rt.last_used_at,
+        rt.expires_at,
+        (SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = rt.family_id)::TIMESTAMP AS started_at
+    FROM refresh_tokens rt
+    WHERE rt.user_id = sqlc.arg(user_id) AND rt.client_id IS NULL AND rt.revoked_at IS NULL AND rt.expires_at > NOW()
+) sessions
+WHERE sqlc.narg(before_started_at)::TIMESTAMP IS NULL
+    OR (started_at, family_id) < (sqlc.narg(before_started_at)::TIMESTAMP, sqlc.narg(before_id)::UUID)
+ORDER BY started_at DESC, family_id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: RevokeUserSession :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1 AND user_id = $2 AND client_id IS NULL AND revoked_at IS NULL;
+
+-- name: ListAuthorizedClientsByUserId :many
+-- Most recently authorized apps first. An app was authorized when the oldest
+-- of its grants still in use began: the first token of a family with an active
+-- token, however many rotations ago. Unlike refreshes, this doesn't move while
+-- a client pages through.
+SELECT id, name, authorized_at, last_used_at
+FROM (
+    SELECT
+        c.id,
+        c.name,
+        MIN(f.created_at)::TIMESTAMP AS authorized_at,
+        MAX(f.last_used_at)::TIMESTAMP AS last_used_at
+    FROM refresh_tokens f
+    JOIN oauth_clients c ON c.id = f.client_id
+    WHERE f.user_id = sqlc.arg(user_id)
+    AND f.family_id IN (
+        SELECT rt.family_id FROM refresh_tokens rt
+        WHERE rt.user_id = sqlc.arg(user_id) AND rt.client_id IS NOT NULL AND rt.revoked_at IS NULL AND rt.expires_at > NOW()
+    )
+    GROUP BY c.id, c.name
+) apps
+WHERE sqlc.narg(before_authorized_at)::TIMESTAMP IS NULL
+    OR (authorized_at, id) < (sqlc.narg(before_authorized_at)::TIMESTAMP, sqlc.narg(before_id)::UUID)
+ORDER BY authorized_at DESC, id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: RevokeClientAuthorization :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE client_id = $1 AND user_id = $2 AND revoked_at IS NULL;
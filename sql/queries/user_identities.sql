@@ -0,0 +1,31 @@
+-- name: CountUserIdentitiesByUserId :one
+SELECT COUNT(*) FROM user_identities
+WHERE user_id = $1;
+
+-- name: CreateUserIdentity :one
+INSERT INTO user_identities (id, created_at, user_id, provider, subject, email)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4
+)
+RETURNING *;
+
+-- name: DeleteUserIdentity :execrows
+DELETE FROM user_identities
+WHERE id = $1 AND user_id = $2;
+
+-- name: GetUserIdentity :one
+SELECT * FROM user_identities
+WHERE provider = $1 AND subject = $2;
+
+-- name: ListUserIdentitiesByUserId :many
+SELECT * FROM user_identities
+WHERE user_id = sqlc.arg(user_id)
+AND (sqlc.narg(after_created_at)::TIMESTAMP IS NULL
+    OR (created_at, id) > (sqlc.narg(after_created_at)::TIMESTAMP, sqlc.narg(after_id)::UUID))
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg(page_size);
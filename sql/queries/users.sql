@@ -1,16 +1,18 @@
 -- name: CreateUser :one
-INSERT INTO users (id, created_at, updated_at, email, hashed_password)
+INSERT INTO users (id, created_at, updated_at, email, hashed_password, handle)
 VALUES (
     gen_random_uuid(),
     NOW(),
     NOW(),
     $1,
-    $2
+    $2,
+    $3
 )
 RETURNING *;
 
--- name: DeleteUsers :exec
-DELETE FROM users;
+-- name: DeleteOtherUsers :exec
+DELETE FROM users
+WHERE id <> $1;
 
 -- name: GetUserByEmail :one
 SELECT * FROM users
@@ -22,10 +24,104 @@ WHERE id = $1;
 
 -- name: UpdateUserById :exec
 UPDATE users 
-SET email = $2, hashed_password = $3
+SET email = $2, hashed_password = $3, updated_at = NOW()
 WHERE id = $1;
 
 -- name: UpdateUserChirpyRedById :exec
 UPDATE users
 SET is_chirpy_red = true
 WHERE id = $1;
+
+-- name: UpdateUserPasswordById :exec
+UPDATE users
+SET hashed_password = $2, updated_at = NOW()
+WHERE id = $1;
+
+-- name: GetUserById :one
+SELECT * FROM users
+WHERE id = $1;
+
+-- name: SetUserPendingEmail :exec
+UPDATE users
+SET pending_email = $2, updated_at = NOW()
+WHERE id = $1;
+
+-- name: VerifyUserEmail :exec
+UPDATE users
+SET email = $2, email_verified_at = NOW(), pending_email = NULL, updated_at = NOW()
+WHERE id = $1;
+
+-- name: SetUserTOTPSecret :exec
+UPDATE users
+SET totp_secret = $2, totp_enabled_at = NULL, totp_last_used_step = NULL, updated_at = NOW()
+WHERE id = $1;
+
+-- name: EnableUserTOTP :exec
+UPDATE users
+SET totp_enabled_at = NOW(), updated_at = NOW()
+WHERE id = $1;
+
+-- name: DisableUserTOTP :exec
+UPDATE users
+SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_used_step = NULL, updated_at = NOW()
+WHERE id = $1;
+
+-- name: UseUserTOTPStep :execrows
+UPDATE users
+SET totp_last_used_step = $2
+WHERE id = $1 AND (totp_last_used_step IS NULL OR totp_last_used_step < $2);
+
+-- name: RehashUserPassword :exec
+UPDATE users
+SET hashed_password = sqlc.arg(new_hash)
+WHERE id = sqlc.arg(id) AND hashed_password = sqlc.arg(old_hash);
+
+-- name: SetUserRoleById :execrows
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE id = $1;
+
+-- name: SetUserRoleByEmail :execrows
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE email = $1;
+
+-- name: ScheduleUserDeletion :one
+UPDATE users
+SET deleted_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING *;
+
+-- name: RestoreUser :execrows
+UPDATE users
+SET deleted_at = NULL, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NOT NULL;
+
+-- name: ListUsersDueForPurge :many
+SELECT id FROM users
+WHERE deleted_at < sqlc.arg(cutoff)::TIMESTAMP;
+
+-- name: LockUserForPurge :one
+-- Locks a user due for purging, so a restore has to wait for the purge or
+-- the purge sees the restore.
+SELECT id FROM users
+WHERE id = sqlc.arg(id) AND deleted_at < sqlc.arg(cutoff)::TIMESTAMP
+FOR UPDATE;
+
+-- name: PurgeUser :execrows
+DELETE FROM users
+WHERE id = sqlc.arg(id) AND deleted_at < sqlc.arg(cutoff)::TIMESTAMP;
+
+-- name: GetUserByHandle :one
+SELECT * FROM users
+WHERE LOWER(handle) = LOWER(sqlc.arg(handle));
+
+-- name: UpdateUserProfile :one
+UPDATE users
+SET handle = $2, display_name = $3, bio = $4, avatar_url = $5, updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: GetUserProfilesByIds :many
+SELECT id, handle, display_name, avatar_url FROM users
+WHERE id = ANY(sqlc.arg(ids)::UUID[]) AND deleted_at IS NULL;
@@ -0,0 +1,21 @@
+-- +goose Up
+UPDATE refresh_tokens
+SET token = encode(sha256(convert_to(token, 'UTF8')), 'hex'),
+    parent_token = encode(sha256(convert_to(parent_token, 'UTF8')), 'hex');
+
+ALTER TABLE refresh_tokens
+RENAME COLUMN token TO token_hash;
+
+ALTER TABLE refresh_tokens
+RENAME COLUMN parent_token TO parent_token_hash;
+
+-- +goose Down
+-- The original tokens cannot be recovered from their digests, so existing
+-- sessions are dropped and users have to log in again.
+DELETE FROM refresh_tokens;
+
+ALTER TABLE refresh_tokens
+RENAME COLUMN parent_token_hash TO parent_token;
+
+ALTER TABLE refresh_tokens
+RENAME COLUMN token_hash TO token;
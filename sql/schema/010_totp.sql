@@ -0,0 +1,32 @@
+-- +goose Up
+ALTER TABLE users
+ADD COLUMN totp_secret TEXT;
+
+ALTER TABLE users
+ADD COLUMN totp_enabled_at TIMESTAMP;
+
+-- Last accepted 30 second time step, so a code cannot be replayed
+ALTER TABLE users
+ADD COLUMN totp_last_used_step BIGINT;
+
+CREATE TABLE mfa_recovery_codes (
+    code_hash TEXT PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX mfa_recovery_codes_user_id_idx ON mfa_recovery_codes (user_id);
+
+-- +goose Down
+DROP TABLE mfa_recovery_codes;
+
+ALTER TABLE users
+DROP COLUMN totp_last_used_step;
+
+ALTER TABLE users
+DROP COLUMN totp_enabled_at;
+
+ALTER TABLE users
+DROP COLUMN totp_secret;
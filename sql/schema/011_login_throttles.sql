@@ -0,0 +1,12 @@
+-- +goose Up
+-- Failed login counters, keyed by "account:<email>" or "ip:<address>".
+-- Kept in the database so every server instance sees the same counts.
+CREATE TABLE login_throttles (
+    key TEXT PRIMARY KEY,
+    failed_attempts INTEGER NOT NULL,
+    last_failed_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE login_throttles;
@@ -0,0 +1,17 @@
+-- +goose Up
+-- Set when the user asks for their account to be deleted. The account is
+-- purged once the grace period has passed, and can be restored until then.
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
+
+-- Chirps can outlive their author, depending on the deletion policy
+ALTER TABLE chirps ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE chirps DROP CONSTRAINT chirps_user_id_fkey;
+ALTER TABLE chirps ADD CONSTRAINT chirps_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL;
+
+-- +goose Down
+DELETE FROM chirps WHERE user_id IS NULL;
+ALTER TABLE chirps DROP CONSTRAINT chirps_user_id_fkey;
+ALTER TABLE chirps ADD CONSTRAINT chirps_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE chirps ALTER COLUMN user_id SET NOT NULL;
+
+ALTER TABLE users DROP COLUMN deleted_at;
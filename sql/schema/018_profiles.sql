@@ -0,0 +1,19 @@
+-- +goose Up
+-- Public profile. Handles are unique regardless of case, but keep the case
+-- the user chose for display.
+ALTER TABLE users ADD COLUMN handle TEXT;
+UPDATE users SET handle = 'user_' || substr(replace(id::text, '-', ''), 1, 12);
+ALTER TABLE users ALTER COLUMN handle SET NOT NULL;
+CREATE UNIQUE INDEX users_handle_key ON users (LOWER(handle));
+
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN avatar_url;
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN display_name;
+
+DROP INDEX users_handle_key;
+ALTER TABLE users DROP COLUMN handle;
@@ -0,0 +1,22 @@
+-- +goose Up
+CREATE TABLE follows (
+    follower_id UUID NOT NULL,
+    FOREIGN KEY (follower_id) REFERENCES users(id) ON DELETE CASCADE,
+    followee_id UUID NOT NULL,
+    FOREIGN KEY (followee_id) REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (follower_id, followee_id),
+    CHECK (follower_id <> followee_id)
+);
+
+-- Follower and following listings are paged newest first
+CREATE INDEX follows_followee_id_created_at_idx ON follows (followee_id, created_at DESC, follower_id DESC);
+CREATE INDEX follows_follower_id_created_at_idx ON follows (follower_id, created_at DESC, followee_id DESC);
+
+-- The timeline reads a page of the newest chirps of each followed account
+-- from here, instead of sorting every chirp they ever wrote
+CREATE INDEX chirps_user_id_created_at_idx ON chirps (user_id, created_at DESC, id DESC);
+
+-- +goose Down
+DROP INDEX chirps_user_id_created_at_idx;
+DROP TABLE follows;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- GET /api/chirps pages through all chirps in creation order, in either
+-- direction. Filtered by author it uses chirps_user_id_created_at_idx.
+CREATE INDEX chirps_created_at_idx ON chirps (created_at, id);
+
+-- +goose Down
+DROP INDEX chirps_created_at_idx;
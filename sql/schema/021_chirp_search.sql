@@ -0,0 +1,11 @@
+-- +goose Up
+-- Adding a stored generated column rewrites the table, which fills it in
+-- for existing chirps. New and edited chirps are kept up to date by Postgres.
+ALTER TABLE chirps ADD COLUMN search_vector TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('english', body)) STORED;
+
+CREATE INDEX chirps_search_vector_idx ON chirps USING GIN (search_vector);
+
+-- +goose Down
+DROP INDEX chirps_search_vector_idx;
+ALTER TABLE chirps DROP COLUMN search_vector;
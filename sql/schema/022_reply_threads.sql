@@ -0,0 +1,25 @@
+-- +goose Up
+-- Replies point at the chirp they answer, and all chirps of a thread share
+-- the ID of its first chirp, so a whole conversation is one index range.
+ALTER TABLE chirps ADD COLUMN in_reply_to_id UUID;
+ALTER TABLE chirps ADD CONSTRAINT chirps_in_reply_to_id_fkey FOREIGN KEY (in_reply_to_id) REFERENCES chirps(id) ON DELETE SET NULL;
+ALTER TABLE chirps ADD COLUMN conversation_id UUID;
+UPDATE chirps SET conversation_id = id;
+ALTER TABLE chirps ALTER COLUMN conversation_id SET NOT NULL;
+
+-- Set when a chirp with replies is deleted. Its body is cleared, but the row
+-- stays as a tombstone so the replies keep their place in the thread.
+ALTER TABLE chirps ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX chirps_in_reply_to_id_idx ON chirps (in_reply_to_id);
+CREATE INDEX chirps_conversation_id_created_at_idx ON chirps (conversation_id, created_at, id);
+
+-- +goose Down
+DROP INDEX chirps_conversation_id_created_at_idx;
+DROP INDEX chirps_in_reply_to_id_idx;
+
+DELETE FROM chirps WHERE deleted_at IS NOT NULL;
+ALTER TABLE chirps DROP COLUMN deleted_at;
+ALTER TABLE chirps DROP COLUMN conversation_id;
+ALTER TABLE chirps DROP CONSTRAINT chirps_in_reply_to_id_fkey;
+ALTER TABLE chirps DROP COLUMN in_reply_to_id;
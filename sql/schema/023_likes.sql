@@ -0,0 +1,40 @@
+-- +goose Up
+CREATE TABLE likes (
+    user_id UUID NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    chirp_id UUID NOT NULL,
+    FOREIGN KEY (chirp_id) REFERENCES chirps(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, chirp_id)
+);
+
+CREATE INDEX likes_chirp_id_idx ON likes (chirp_id);
+
+-- Denormalized so listings don't count likes per chirp. A trigger keeps it
+-- in step with the likes table, including likes removed by ON DELETE
+-- CASCADE when an account is purged. Concurrent likes of one chirp queue on
+-- its row lock, so none are lost.
+ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+
+-- +goose StatementBegin
+CREATE FUNCTION update_chirp_like_count() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        UPDATE chirps SET like_count = like_count + 1 WHERE id = NEW.chirp_id;
+    ELSE
+        UPDATE chirps SET like_count = like_count - 1 WHERE id = OLD.chirp_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER likes_update_chirp_like_count
+AFTER INSERT OR DELETE ON likes
+FOR EACH ROW EXECUTE FUNCTION update_chirp_like_count();
+
+-- +goose Down
+DROP TRIGGER likes_update_chirp_like_count ON likes;
+DROP FUNCTION update_chirp_like_count();
+ALTER TABLE chirps DROP COLUMN like_count;
+DROP TABLE likes;
@@ -0,0 +1,65 @@
+-- +goose Up
+-- A rechirp shares another chirp without text of its own. It goes away with
+-- the chirp it shares.
+ALTER TABLE chirps ADD COLUMN rechirp_of_id UUID;
+ALTER TABLE chirps ADD CONSTRAINT chirps_rechirp_of_id_fkey
+    FOREIGN KEY (rechirp_of_id) REFERENCES chirps(id) ON DELETE CASCADE;
+
+-- A quote has a body of its own. Quoted chirps become tombstones when
+-- deleted, like chirps with replies; SET NULL only matters for bulk deletes.
+ALTER TABLE chirps ADD COLUMN quote_of_id UUID;
+ALTER TABLE chirps ADD CONSTRAINT chirps_quote_of_id_fkey
+    FOREIGN KEY (quote_of_id) REFERENCES chirps(id) ON DELETE SET NULL;
+
+ALTER TABLE chirps ADD CONSTRAINT chirps_rechirp_check
+    CHECK (rechirp_of_id IS NULL OR (body = '' AND in_reply_to_id IS NULL AND quote_of_id IS NULL));
+
+CREATE UNIQUE INDEX chirps_user_id_rechirp_of_id_key ON chirps (user_id, rechirp_of_id)
+    WHERE rechirp_of_id IS NOT NULL;
+CREATE INDEX chirps_rechirp_of_id_idx ON chirps (rechirp_of_id);
+CREATE INDEX chirps_quote_of_id_idx ON chirps (quote_of_id);
+
+-- Kept up to date by a trigger, like like_count
+ALTER TABLE chirps ADD COLUMN rechirp_count INTEGER NOT NULL DEFAULT 0;
+
+-- +goose StatementBegin
+CREATE FUNCTION update_chirp_rechirp_count() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' AND NEW.rechirp_of_id IS NOT NULL THEN
+        UPDATE chirps SET rechirp_count = rechirp_count + 1 WHERE id = NEW.rechirp_of_id;
+    ELSIF TG_OP = 'DELETE' AND OLD.rechirp_of_id IS NOT NULL THEN
+        UPDATE chirps SET rechirp_count = rechirp_count - 1 WHERE id = OLD.rechirp_of_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER chirps_update_rechirp_count
+AFTER INSERT OR DELETE ON chirps
+FOR EACH ROW EXECUTE FUNCTION update_chirp_rechirp_count();
+
+-- Rechirps of a chirp that became a tombstone go too, as if it was deleted
+-- +goose StatementBegin
+CREATE FUNCTION delete_rechirps_of_tombstone() RETURNS TRIGGER AS $$
+BEGIN
+    DELETE FROM chirps WHERE rechirp_of_id = NEW.id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER chirps_delete_rechirps_of_tombstone
+AFTER UPDATE OF deleted_at ON chirps
+FOR EACH ROW WHEN (OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL)
+EXECUTE FUNCTION delete_rechirps_of_tombstone();
+
+-- +goose Down
+DROP TRIGGER chirps_delete_rechirps_of_tombstone ON chirps;
+DROP FUNCTION delete_rechirps_of_tombstone();
+DROP TRIGGER chirps_update_rechirp_count ON chirps;
+DROP FUNCTION update_chirp_rechirp_count();
+ALTER TABLE chirps DROP COLUMN rechirp_count;
+DELETE FROM chirps WHERE rechirp_of_id IS NOT NULL;
+ALTER TABLE chirps DROP COLUMN quote_of_id;
+ALTER TABLE chirps DROP COLUMN rechirp_of_id;
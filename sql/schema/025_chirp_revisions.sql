@@ -0,0 +1,36 @@
+-- +goose Up
+-- Earlier bodies of edited chirps. created_at is when the body was written,
+-- replaced_at when an edit replaced it.
+CREATE TABLE chirp_revisions (
+    id UUID PRIMARY KEY,
+    chirp_id UUID NOT NULL,
+    FOREIGN KEY (chirp_id) REFERENCES chirps(id) ON DELETE CASCADE,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    replaced_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX chirp_revisions_chirp_id_replaced_at_idx ON chirp_revisions (chirp_id, replaced_at DESC, id DESC);
+
+ALTER TABLE chirps ADD COLUMN edit_count INTEGER NOT NULL DEFAULT 0;
+
+-- A tombstone keeps no text, earlier versions included
+-- +goose StatementBegin
+CREATE FUNCTION delete_revisions_of_tombstone() RETURNS TRIGGER AS $$
+BEGIN
+    DELETE FROM chirp_revisions WHERE chirp_id = NEW.id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER chirps_delete_revisions_of_tombstone
+AFTER UPDATE OF deleted_at ON chirps
+FOR EACH ROW WHEN (OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL)
+EXECUTE FUNCTION delete_revisions_of_tombstone();
+
+-- +goose Down
+DROP TRIGGER chirps_delete_revisions_of_tombstone ON chirps;
+DROP FUNCTION delete_revisions_of_tombstone();
+ALTER TABLE chirps DROP COLUMN edit_count;
+DROP TABLE chirp_revisions;
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/ValentinoFilipetto/chirpy/internal/database"
+	"github.com/ValentinoFilipetto/chirpy/internal/pagination"
+	"github.com/google/uuid"
+)
+
+// getThreadHandler returns a chirp in the context of its conversation: the
+// chirps it replies to, root first, and a page of the replies below it.
+// Replies come oldest first, so every reply follows the chirp it answers
+// and clients can build the tree from in_reply_to_id as pages arrive.
+func (cfg *apiConfig) getThreadHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := uuid.Parse(r.PathValue("chirpID"))
+
+	if err != nil {
+		respondWithError(w, 400, "Invalid chirpID")
+		return
+	}
+
+	page, err := pagination.FromQuery(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirp, err := cfg.DB.GetChirp(r.Context(), chirpID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving chirp from database: %s", err)
+		respondWithError(w, 500, "Error retrieving thread")
+		return
+	}
+
+	ancestors, err := cfg.DB.GetChirpAncestors(r.Context(), chirp.ID)
+
+	if err != nil {
+		log.Printf("Error retrieving chirp ancestors: %s", err)
+		respondWithError(w, 500, "Error retrieving thread")
+		return
+	}
+
+	afterCreatedAt, afterID := cursorArgs(page.After)
+
+	var replies []database.ListDescendantRepliesRow
+
+	// Below the root, the whole conversation is the thread, no need to walk the tree
+	if chirp.ConversationID == chirp.ID {
+		var rows []database.ListConversationRepliesRow
+		rows, err = cfg.DB.ListConversationReplies(r.Context(), database.ListConversationRepliesParams{
+			RootID:         chirp.ID,
+			AfterCreatedAt: afterCreatedAt,
+			AfterID:        afterID,
+			PageSize:       int32(page.Limit + 1),
+		})
+
+		for _, row := range rows {
+			replies = append(replies, database.ListDescendantRepliesRow(row))
+		}
+	} else {
+		replies, err = cfg.DB.ListDescendantReplies(r.Context(), database.ListDescendantRepliesParams{
+			ChirpID:        chirp.ID,
+			AfterCreatedAt: afterCreatedAt,
+			AfterID:        afterID,
+			PageSize:       int32(page.Limit + 1),
+		})
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving chirp replies: %s", err)
+		respondWithError(w, 500, "Error retrieving thread")
+		return
+	}
+
+	replies, next := pagination.Cut(replies, page, chirpCursor)
+
+	// Everything in one slice, so authors and likes are looked up once
+	chirps := make([]Chirp, 0, len(ancestors)+1+len(replies))
+
+	for _, ancestor := range ancestors {
+		chirps = append(chirps, toChirp(ancestor))
+	}
+
+	chirps = append(chirps, toChirp(chirp))
+
+	for _, reply := range replies {
+		chirps = append(chirps, toChirp(reply))
+	}
+
+	err = cfg.prepareChirps(r, chirps)
+
+	if err != nil {
+		log.Printf("Error preparing chirps: %s", err)
+		respondWithError(w, 500, "Error retrieving thread")
+		return
+	}
+
+	respBody := struct {
+		Ancestors  []Chirp `json:"ancestors"`
+		Chirp      Chirp   `json:"chirp"`
+		Replies    []Chirp `json:"replies"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}{
+		Ancestors:  chirps[:len(ancestors)],
+		Chirp:      chirps[len(ancestors)],
+		Replies:    chirps[len(ancestors)+1:],
+		NextCursor: next,
+	}
+
+	pagination.SetNextLink(w.Header(), r.URL, next)
+	respondWithJSON(w, 200, respBody)
+}
+
+// pruneTombstones deletes the tombstones among chirpIDs that nothing replies
+// to or quotes anymore, and then those above them that became unreferenced.
+// Call it with what a hard-deleted chirp replied to and quoted.
+func pruneTombstones(ctx context.Context, q *database.Queries, chirpIDs []uuid.UUID) error {
+	for len(chirpIDs) > 0 {
+		chirpID := chirpIDs[len(chirpIDs)-1]
+		chirpIDs = chirpIDs[:len(chirpIDs)-1]
+
+		refs, err := q.DeleteUnreferencedTombstone(ctx, chirpID)
+
+		// Not a tombstone, or still needed
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		chirpIDs = appendChirpRefs(chirpIDs, refs.InReplyToID, refs.QuoteOfID)
+	}
+
+	return nil
+}
+
+// appendChirpRefs adds the set IDs among refs to chirpIDs.
+func appendChirpRefs(chirpIDs []uuid.UUID, refs ...uuid.NullUUID) []uuid.UUID {
+	for _, ref := range refs {
+		if ref.Valid {
+			chirpIDs = append(chirpIDs, ref.UUID)
+		}
+	}
+
+	return chirpIDs
+}